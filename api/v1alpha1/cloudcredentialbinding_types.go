@@ -0,0 +1,113 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The types of the conditions in the status of a CloudCredentialBinding, one
+// for each provider
+const (
+	ConditionAWSReady = "AWSReady"
+	ConditionGCPReady = "GCPReady"
+)
+
+// CloudCredentialBindingSpec binds cloud credentials to a service account.
+// Each provider is optional, but at least one should be set.
+type CloudCredentialBindingSpec struct {
+	// ServiceAccountName is the name of the service account, in the same
+	// namespace, that the credentials are bound to
+	ServiceAccountName string `json:"serviceAccountName"`
+
+	// AWS configures the aws secret role for the service account
+	// +optional
+	AWS *AWSCredentialBinding `json:"aws,omitempty"`
+
+	// GCP configures the gcp secret roleset for the service account
+	// +optional
+	GCP *GCPCredentialBinding `json:"gcp,omitempty"`
+}
+
+// AWSCredentialBinding configures the aws secret role, with the same settings
+// as the vault.uw.systems/aws-* annotations
+type AWSCredentialBinding struct {
+	// CredentialType is one of assumed_role (default), federation_token
+	// or iam_user
+	// +optional
+	CredentialType string `json:"credentialType,omitempty"`
+
+	// RoleArns are the roles that can be assumed
+	// +optional
+	RoleArns []string `json:"roleArns,omitempty"`
+
+	// STSTTL is the ttl of the credentials
+	// +optional
+	STSTTL *metav1.Duration `json:"stsTTL,omitempty"`
+
+	// MaxSTSTTL is the maximum ttl that can be requested
+	// +optional
+	MaxSTSTTL *metav1.Duration `json:"maxSTSTTL,omitempty"`
+
+	// PolicyDocument is an IAM policy document that scopes down the
+	// credentials
+	// +optional
+	PolicyDocument string `json:"policyDocument,omitempty"`
+
+	// PolicyArns are managed policies that scope down the credentials
+	// +optional
+	PolicyArns []string `json:"policyArns,omitempty"`
+
+	// IAMGroups are groups whose policies scope down the credentials
+	// +optional
+	IAMGroups []string `json:"iamGroups,omitempty"`
+}
+
+// GCPCredentialBinding configures the gcp secret roleset, with the same
+// settings as the vault.uw.systems/gcp-* annotations
+type GCPCredentialBinding struct {
+	// Project is the project that the roleset's service account is
+	// created in
+	Project string `json:"project"`
+
+	// Bindings maps resource names to the roles that are bound on them
+	Bindings map[string][]string `json:"bindings"`
+
+	// TokenScopes are the scopes of the access tokens, defaulting to
+	// https://www.googleapis.com/auth/cloud-platform
+	// +optional
+	TokenScopes []string `json:"tokenScopes,omitempty"`
+}
+
+// CloudCredentialBindingStatus is the observed state of a
+// CloudCredentialBinding
+type CloudCredentialBindingStatus struct {
+	// Conditions report whether the credentials for each provider have
+	// been written to vault
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+
+// CloudCredentialBinding binds cloud credentials in vault to a service
+// account, as an alternative to annotating the service account
+type CloudCredentialBinding struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CloudCredentialBindingSpec   `json:"spec,omitempty"`
+	Status CloudCredentialBindingStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// CloudCredentialBindingList is a list of CloudCredentialBindings
+type CloudCredentialBindingList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []CloudCredentialBinding `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&CloudCredentialBinding{}, &CloudCredentialBindingList{})
+}
@@ -0,0 +1,107 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CloudCredentialPolicySpec contains rules that are added to the rules in
+// the config file of the operator
+type CloudCredentialPolicySpec struct {
+	// AWS contains rules for the aws operator
+	// +optional
+	AWS *AWSCredentialPolicy `json:"aws,omitempty"`
+}
+
+// AWSCredentialPolicy contains rules for the aws operator
+type AWSCredentialPolicy struct {
+	// Rules permit service accounts in the matching namespaces to have
+	// credentials for the matching roles
+	Rules []AWSPolicyRule `json:"rules"`
+}
+
+// AWSPolicyRule has the same fields as the aws rules in the config file of
+// the operator
+type AWSPolicyRule struct {
+	// Name identifies the rule in logs and events
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// Effect is either allow (default) or deny. Deny rules take
+	// precedence over allow rules.
+	// +optional
+	Effect string `json:"effect,omitempty"`
+
+	// NamespacePatterns match the names of the namespaces of the service
+	// accounts
+	// +optional
+	NamespacePatterns []string `json:"namespacePatterns,omitempty"`
+
+	// NamespaceSelector matches the labels of the namespaces of the
+	// service accounts. If it's set along with NamespacePatterns then a
+	// namespace must match both.
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+
+	// RoleNamePatterns match the names of the roles
+	// +optional
+	RoleNamePatterns []string `json:"roleNamePatterns,omitempty"`
+
+	// RoleNameRegexps are regular expressions that match the whole names
+	// of the roles, including their path
+	// +optional
+	RoleNameRegexps []string `json:"roleNameRegexps,omitempty"`
+
+	// AccountIDs are the accounts of the roles. Any account is permitted
+	// if it's empty.
+	// +optional
+	AccountIDs []string `json:"accountIDs,omitempty"`
+
+	// MaxTTL is the upper bound for the sts ttls of the roles
+	// +optional
+	MaxTTL *metav1.Duration `json:"maxTTL,omitempty"`
+
+	// CredentialTypes are the types of credentials that are permitted,
+	// defaulting to assumed_role
+	// +optional
+	CredentialTypes []string `json:"credentialTypes,omitempty"`
+
+	// PolicyArnPatterns match the policy arns that federation_token and
+	// iam_user credentials can have
+	// +optional
+	PolicyArnPatterns []string `json:"policyArnPatterns,omitempty"`
+
+	// IAMGroupPatterns match the iam groups that federation_token and
+	// iam_user credentials can have
+	// +optional
+	IAMGroupPatterns []string `json:"iamGroupPatterns,omitempty"`
+
+	// AllowPolicyDocument permits federation_token and iam_user
+	// credentials to have an inline policy document
+	// +optional
+	AllowPolicyDocument bool `json:"allowPolicyDocument,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster
+
+// CloudCredentialPolicy permits service accounts to have cloud credentials,
+// as an alternative to the rules in the config file of the operator
+type CloudCredentialPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec CloudCredentialPolicySpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// CloudCredentialPolicyList is a list of CloudCredentialPolicies
+type CloudCredentialPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []CloudCredentialPolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&CloudCredentialPolicy{}, &CloudCredentialPolicyList{})
+}
@@ -0,0 +1,20 @@
+// Package v1alpha1 contains the custom resources managed by the operator
+// +kubebuilder:object:generate=true
+// +groupName=vault.uw.systems
+package v1alpha1
+
+import (
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/scheme"
+)
+
+var (
+	// GroupVersion is the group and version of the resources
+	GroupVersion = schema.GroupVersion{Group: "vault.uw.systems", Version: "v1alpha1"}
+
+	// SchemeBuilder registers the resources with a scheme
+	SchemeBuilder = &scheme.Builder{GroupVersion: GroupVersion}
+
+	// AddToScheme adds the resources to a scheme
+	AddToScheme = SchemeBuilder.AddToScheme
+)
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"strings"
 	"time"
 
 	vault "github.com/hashicorp/vault/api"
+	"github.com/utilitywarehouse/vault-kube-cloud-credentials/api/v1alpha1"
 	"github.com/utilitywarehouse/vault-kube-cloud-credentials/operator"
 	"github.com/utilitywarehouse/vault-kube-cloud-credentials/sidecar"
 	corev1 "k8s.io/api/core/v1"
@@ -21,10 +25,17 @@ var (
 	operatorCommand             = flag.NewFlagSet("operator", flag.ExitOnError)
 	flagOperatorPrefix          = operatorCommand.String("prefix", "vkcc", "This prefix is prepended to all the roles and policies created in vault")
 	flagOperatorAWSBackend      = operatorCommand.String("aws-backend", "aws", "AWS secret backend path")
+	flagOperatorGCPBackend      = operatorCommand.String("gcp-backend", "gcp", "GCP secret backend path")
 	flagOperatorKubeAuthBackend = operatorCommand.String("kube-auth-backend", "kubernetes", "Kubernetes auth backend")
+	flagOperatorKubeAudience    = operatorCommand.String("kube-auth-audience", "", "Audience that the kubernetes auth roles require in service account tokens, for use with projected tokens")
 	flagOperatorMetricsAddr     = operatorCommand.String("metrics-address", ":8080", "Metrics address")
 	flagOperatorConfigFile      = operatorCommand.String("config-file", "", "Path to a configuration file")
+	flagOperatorConfigReload    = operatorCommand.Duration("config-reload-interval", 10*time.Second, "How often to check the configuration file for changes and reload the rules, disabled if 0")
 	flagOperatorDefaultTTL      = operatorCommand.Duration("default-sts-ttl", 900*time.Second, "Default ttl for AWS credentials")
+	flagOperatorWebhookPort     = operatorCommand.Int("webhook-port", 0, "Serve a validating admission webhook for service accounts on this port, disabled if 0")
+	flagOperatorWebhookCertDir  = operatorCommand.String("webhook-cert-dir", "/tmp/k8s-webhook-server/serving-certs", "Directory containing the tls.crt and tls.key served by the webhook")
+	flagOperatorBindings        = operatorCommand.Bool("credential-bindings", false, "Reconcile CloudCredentialBinding resources, which take precedence over service account annotations. Requires the CRD.")
+	flagOperatorPolicies        = operatorCommand.Bool("credential-policies", false, "Add the rules in CloudCredentialPolicy resources to the rules in the config file. Requires the CRD.")
 
 	awsSidecarCommand    = flag.NewFlagSet("aws-sidecar", flag.ExitOnError)
 	flagAWSPrefix        = awsSidecarCommand.String("prefix", "vkcc", "The prefix used by the operator to create the login and backend roles")
@@ -33,9 +44,47 @@ var (
 	flagAWSRole          = awsSidecarCommand.String("role", "", "AWS secret role, defaults to <prefix>_aws_<namespace>_<service-account>")
 	flagAWSKubeAuthRole  = awsSidecarCommand.String("kube-auth-role", "", "Kubernetes auth role, defaults to <prefix>_aws_<namespace>_<service-account>")
 	flagAWSKubeBackend   = awsSidecarCommand.String("kube-auth-backend", "kubernetes", "Kubernetes auth backend")
-	flagAWSKubeTokenPath = awsSidecarCommand.String("kube-token-path", "/var/run/secrets/kubernetes.io/serviceaccount/token", "Path to the kubernetes serviceaccount token")
-	flagAWSListenAddr    = awsSidecarCommand.String("listen-address", "127.0.0.1:8098", "Listen address")
+	flagAWSKubeTokenPath = awsSidecarCommand.String("kube-token-path", "/var/run/secrets/kubernetes.io/serviceaccount/token", "Path to the kubernetes serviceaccount token, which can be a legacy or projected token")
+	flagAWSListenAddr    = awsSidecarCommand.String("listen-address", "127.0.0.1:8098", "Listen address, set to an empty string to disable the HTTP endpoints")
+	flagAWSCredsFile     = awsSidecarCommand.String("credentials-file", "", "Write credentials to this file, in the shared credentials file format, after every renewal")
+	flagAWSProfile       = awsSidecarCommand.String("profile", "default", "Name of the profile in the credentials file")
 	flagAWSOpsAddr       = awsSidecarCommand.String("operational-address", ":8099", "Listen address for operational status endpoints")
+	flagAWSCredsFormat   = awsSidecarCommand.String("credentials-format", "", "Format of the credentials written to -credentials-file or stdout: ini (default), json, credential-process or env")
+	flagAWSOnce          = awsSidecarCommand.Bool("once", false, "Retrieve credentials once, write them to -credentials-file (or stdout) and exit")
+	flagAWSIMDS          = awsSidecarCommand.Bool("imds", false, "Emulate the EC2 instance metadata service, in addition to serving credentials at /credentials")
+	flagAWSIMDSv2        = awsSidecarCommand.Bool("imds-v2-required", false, "Require an IMDSv2 session token for requests to the EC2 instance metadata endpoints")
+	flagAWSRegion        = awsSidecarCommand.String("region", os.Getenv("AWS_REGION"), "AWS region served by the EC2 instance metadata endpoints, defaults to $AWS_REGION")
+	flagAWSAuthTokenFile = awsSidecarCommand.String("authorization-token-file", "", "Require requests to /credentials to present the token in this file in the Authorization header. A token is generated and written to the file if it doesn't exist.")
+	flagAWSRevoke        = awsSidecarCommand.Bool("revoke-on-shutdown", true, "Revoke the credentials lease and the vault token on SIGINT or SIGTERM")
+	flagAWSShutdownTO    = awsSidecarCommand.Duration("shutdown-timeout", 10*time.Second, "How long to wait for in-flight requests and revocation when shutting down")
+	flagAWSProfileRoles  = &awsProfileRolesFlag{}
+	flagAWSExpiryMargin  = awsSidecarCommand.Duration("expiry-margin", time.Minute, "Stop serving credentials this long before they expire, and renew them before then")
+	flagAWSCredType      = awsSidecarCommand.String("credential-type", sidecar.AWSCredentialTypeAssumedRole, "Type of credentials to retrieve: assumed_role, federation_token or iam_user")
+
+	awsCredentialProcessCommand = flag.NewFlagSet("aws-credential-process", flag.ExitOnError)
+	flagAWSCPPrefix             = awsCredentialProcessCommand.String("prefix", "vkcc", "The prefix used by the operator to create the login and backend roles")
+	flagAWSCPBackend            = awsCredentialProcessCommand.String("backend", "aws", "AWS secret backend path")
+	flagAWSCPRoleArn            = awsCredentialProcessCommand.String("role-arn", "", "AWS role arn to assume")
+	flagAWSCPRole               = awsCredentialProcessCommand.String("role", "", "AWS secret role, defaults to <prefix>_aws_<namespace>_<service-account>")
+	flagAWSCPKubeAuthRole       = awsCredentialProcessCommand.String("kube-auth-role", "", "Kubernetes auth role, defaults to <prefix>_aws_<namespace>_<service-account>")
+	flagAWSCPKubeBackend        = awsCredentialProcessCommand.String("kube-auth-backend", "kubernetes", "Kubernetes auth backend")
+	flagAWSCPKubeTokenPath      = awsCredentialProcessCommand.String("kube-token-path", "/var/run/secrets/kubernetes.io/serviceaccount/token", "Path to the kubernetes serviceaccount token, which can be a legacy or projected token")
+	flagAWSCPSidecarURL         = awsCredentialProcessCommand.String("sidecar-url", "", "Retrieve credentials from a running aws-sidecar at this url (e.g http://127.0.0.1:8098/credentials), rather than from vault")
+	flagAWSCPAuthTokenFile      = awsCredentialProcessCommand.String("authorization-token-file", "", "Path to the authorization token required by the aws-sidecar at -sidecar-url")
+	flagAWSCPCredType           = awsCredentialProcessCommand.String("credential-type", sidecar.AWSCredentialTypeAssumedRole, "Type of credentials to retrieve: assumed_role, federation_token or iam_user")
+
+	awsExecCommand          = flag.NewFlagSet("aws-exec", flag.ExitOnError)
+	flagAWSExecPrefix       = awsExecCommand.String("prefix", "vkcc", "The prefix used by the operator to create the login and backend roles")
+	flagAWSExecBackend      = awsExecCommand.String("backend", "aws", "AWS secret backend path")
+	flagAWSExecRoleArn      = awsExecCommand.String("role-arn", "", "AWS role arn to assume")
+	flagAWSExecRole         = awsExecCommand.String("role", "", "AWS secret role, defaults to <prefix>_aws_<namespace>_<service-account>")
+	flagAWSExecKubeAuthRole = awsExecCommand.String("kube-auth-role", "", "Kubernetes auth role, defaults to <prefix>_aws_<namespace>_<service-account>")
+	flagAWSExecKubeBackend  = awsExecCommand.String("kube-auth-backend", "kubernetes", "Kubernetes auth backend")
+	flagAWSExecKubeToken    = awsExecCommand.String("kube-token-path", "/var/run/secrets/kubernetes.io/serviceaccount/token", "Path to the kubernetes serviceaccount token, which can be a legacy or projected token")
+	flagAWSExecOpsAddr      = awsExecCommand.String("operational-address", "", "Listen address for operational status endpoints, disabled if empty")
+	flagAWSExecRevoke       = awsExecCommand.Bool("revoke-on-shutdown", true, "Revoke the credentials lease and the vault token when the command exits")
+	flagAWSExecExpiryMargin = awsExecCommand.Duration("expiry-margin", time.Minute, "Stop serving credentials this long before they expire, and renew them before then")
+	flagAWSExecCredType     = awsExecCommand.String("credential-type", sidecar.AWSCredentialTypeAssumedRole, "Type of credentials to retrieve: assumed_role, federation_token or iam_user")
 
 	gcpSidecarCommand    = flag.NewFlagSet("gcp-sidecar", flag.ExitOnError)
 	flagGCPPrefix        = gcpSidecarCommand.String("prefix", "vkcc", "The prefix used by the operator to create the login and backend roles")
@@ -43,13 +92,127 @@ var (
 	flagGCPRoleSet       = gcpSidecarCommand.String("roleset", "", "GCP secret roleset, defaults to <prefix>_gcp_<namespace>_<service-account>")
 	flagGCPKubeAuthRole  = gcpSidecarCommand.String("kube-auth-role", "", "Kubernetes auth role, defaults to <prefix>_gcp_<namespace>_<service-account>")
 	flagGCPKubeBackend   = gcpSidecarCommand.String("kube-auth-backend", "kubernetes", "Kubernetes auth backend")
-	flagGCPKubeTokenPath = gcpSidecarCommand.String("kube-token-path", "/var/run/secrets/kubernetes.io/serviceaccount/token", "Path to the kubernetes serviceaccount token")
-	flagGCPListenAddr    = gcpSidecarCommand.String("listen-address", "127.0.0.1:8098", "Listen address")
+	flagGCPKubeTokenPath = gcpSidecarCommand.String("kube-token-path", "/var/run/secrets/kubernetes.io/serviceaccount/token", "Path to the kubernetes serviceaccount token, which can be a legacy or projected token")
+	flagGCPListenAddr    = gcpSidecarCommand.String("listen-address", "127.0.0.1:8098", "Listen address, set to an empty string to disable the HTTP endpoints")
+	flagGCPCredsFile     = gcpSidecarCommand.String("credentials-file", "", "Write the access token to this file after every renewal")
 	flagGCPOpsAddr       = gcpSidecarCommand.String("operational-address", ":8099", "Listen address for operational status endpoints")
+	flagGCPCredsFormat   = gcpSidecarCommand.String("credentials-format", "", "Format of the credentials written to -credentials-file or stdout: token (default) or json")
+	flagGCPOnce          = gcpSidecarCommand.Bool("once", false, "Retrieve credentials once, write them to -credentials-file (or stdout) and exit")
+	flagGCPRevoke        = gcpSidecarCommand.Bool("revoke-on-shutdown", true, "Revoke the vault token on SIGINT or SIGTERM")
+	flagGCPShutdownTO    = gcpSidecarCommand.Duration("shutdown-timeout", 10*time.Second, "How long to wait for in-flight requests and revocation when shutting down")
+	flagGCPExpiryMargin  = gcpSidecarCommand.Duration("expiry-margin", time.Minute, "Stop serving credentials this long before they expire, and renew them before then")
+
+	gcpExecCommand          = flag.NewFlagSet("gcp-exec", flag.ExitOnError)
+	flagGCPExecPrefix       = gcpExecCommand.String("prefix", "vkcc", "The prefix used by the operator to create the login and backend roles")
+	flagGCPExecBackend      = gcpExecCommand.String("backend", "gcp", "GCP secret backend path")
+	flagGCPExecRoleSet      = gcpExecCommand.String("roleset", "", "GCP secret roleset, defaults to <prefix>_gcp_<namespace>_<service-account>")
+	flagGCPExecKubeAuthRole = gcpExecCommand.String("kube-auth-role", "", "Kubernetes auth role, defaults to <prefix>_gcp_<namespace>_<service-account>")
+	flagGCPExecKubeBackend  = gcpExecCommand.String("kube-auth-backend", "kubernetes", "Kubernetes auth backend")
+	flagGCPExecKubeToken    = gcpExecCommand.String("kube-token-path", "/var/run/secrets/kubernetes.io/serviceaccount/token", "Path to the kubernetes serviceaccount token, which can be a legacy or projected token")
+	flagGCPExecOpsAddr      = gcpExecCommand.String("operational-address", "", "Listen address for operational status endpoints, disabled if empty")
+	flagGCPExecRevoke       = gcpExecCommand.Bool("revoke-on-shutdown", true, "Revoke the vault token when the command exits")
+	flagGCPExecExpiryMargin = gcpExecCommand.Duration("expiry-margin", time.Minute, "Stop serving credentials this long before they expire, and renew them before then")
 
 	log = ctrl.Log.WithName("main")
 )
 
+func init() {
+	awsSidecarCommand.Var(flagAWSProfileRoles, "profile-role-arn", "Additional role to assume, as <profile>=<role-arn>, served at /credentials/<profile> and as a named profile in the credentials file. Can be repeated.")
+}
+
+// awsProfileRolesFlag collects the values of a repeated <profile>=<role-arn>
+// flag
+type awsProfileRolesFlag struct {
+	names    []string
+	roleArns map[string]string
+}
+
+// String returns the flag values, joined by commas
+func (f *awsProfileRolesFlag) String() string {
+	var values []string
+	for _, name := range f.names {
+		values = append(values, name+"="+f.roleArns[name])
+	}
+
+	return strings.Join(values, ",")
+}
+
+// Set parses and adds a <profile>=<role-arn> value
+func (f *awsProfileRolesFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("expected <profile>=<role-arn>: %s", value)
+	}
+	if _, ok := f.roleArns[parts[0]]; ok {
+		return fmt.Errorf("duplicate profile: %s", parts[0])
+	}
+	if f.roleArns == nil {
+		f.roleArns = make(map[string]string)
+	}
+	f.names = append(f.names, parts[0])
+	f.roleArns[parts[0]] = parts[1]
+
+	return nil
+}
+
+// roles returns an AWSRole for each profile, using the given vault role
+func (f *awsProfileRolesFlag) roles(role string) []*sidecar.AWSRole {
+	var roles []*sidecar.AWSRole
+	for _, name := range f.names {
+		roles = append(roles, &sidecar.AWSRole{
+			Name:    name,
+			RoleArn: f.roleArns[name],
+			Role:    role,
+		})
+	}
+
+	return roles
+}
+
+// checkAWSCredentialType returns an error if the credential type isn't one
+// that the aws secrets engine can issue, or if it's combined with role arns,
+// which only apply to assumed roles
+func checkAWSCredentialType(credentialType, roleArn string, profileRoles bool) error {
+	switch credentialType {
+	case sidecar.AWSCredentialTypeAssumedRole:
+		return nil
+	case sidecar.AWSCredentialTypeFederationToken, sidecar.AWSCredentialTypeIAMUser:
+		if roleArn != "" || profileRoles {
+			return fmt.Errorf("role arns can only be used with %s credentials", sidecar.AWSCredentialTypeAssumedRole)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported credential type: %s", credentialType)
+	}
+}
+
+// checkAWSIMDS returns an error if the instance metadata endpoints are
+// enabled alongside an authorization token. The metadata endpoints can't
+// require the token, so they would serve the credentials that the token is
+// meant to protect.
+func checkAWSIMDS(imds bool, authorizationTokenFile string) error {
+	if imds && authorizationTokenFile != "" {
+		return fmt.Errorf("-imds can't be used with -authorization-token-file, the instance metadata endpoints don't require the authorization token")
+	}
+
+	return nil
+}
+
+// onceExitCode returns the exit code for an error returned by
+// sidecar.RunOnce, which indicates the stage that failed
+func onceExitCode(err error) int {
+	switch {
+	case errors.Is(err, sidecar.ErrLogin):
+		return 2
+	case errors.Is(err, sidecar.ErrCredentials):
+		return 3
+	case errors.Is(err, sidecar.ErrOutput):
+		return 4
+	default:
+		return 1
+	}
+}
+
 func usage() {
 	fmt.Printf(
 		`Usage:
@@ -58,7 +221,11 @@ func usage() {
 Commands:
   operator      Run the operator
   aws-sidecar   Sidecar for AWS credentials
+  aws-credential-process
+                Print AWS credentials in the format expected by credential_process
   gcp-sidecar   Sidecar for GCP credentials
+  aws-exec      Run a command with AWS credentials: aws-exec [flags] -- command [args]
+  gcp-exec      Run a command with GCP credentials: gcp-exec [flags] -- command [args]
 `, os.Args[0])
 }
 
@@ -79,9 +246,18 @@ func main() {
 	case "aws-sidecar":
 		logOpts.BindFlags(awsSidecarCommand)
 		awsSidecarCommand.Parse(os.Args[2:])
+	case "aws-credential-process":
+		logOpts.BindFlags(awsCredentialProcessCommand)
+		awsCredentialProcessCommand.Parse(os.Args[2:])
 	case "gcp-sidecar":
 		logOpts.BindFlags(gcpSidecarCommand)
 		gcpSidecarCommand.Parse(os.Args[2:])
+	case "aws-exec":
+		logOpts.BindFlags(awsExecCommand)
+		awsExecCommand.Parse(os.Args[2:])
+	case "gcp-exec":
+		logOpts.BindFlags(gcpExecCommand)
+		gcpExecCommand.Parse(os.Args[2:])
 	default:
 		usage()
 		return
@@ -104,11 +280,14 @@ func main() {
 
 		_ = clientgoscheme.AddToScheme(scheme)
 		_ = corev1.AddToScheme(scheme)
+		_ = v1alpha1.AddToScheme(scheme)
 
 		mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 			Scheme:             scheme,
 			MetricsBindAddress: *flagOperatorMetricsAddr,
 			LeaderElection:     false,
+			Port:               *flagOperatorWebhookPort,
+			CertDir:            *flagOperatorWebhookCertDir,
 		})
 		if err != nil {
 			log.Error(err, "error creating manager")
@@ -121,15 +300,23 @@ func main() {
 			log.Error(err, "error creating vault client")
 			os.Exit(1)
 		}
+
+		operatorConfig := &operator.Config{
+			CredentialBindings:     *flagOperatorBindings,
+			CredentialPolicies:     *flagOperatorPolicies,
+			KubeClient:             mgr.GetClient(),
+			KubernetesAuthAudience: *flagOperatorKubeAudience,
+			KubernetesAuthBackend:  *flagOperatorKubeAuthBackend,
+			Prefix:                 *flagOperatorPrefix,
+			Recorder:               mgr.GetEventRecorderFor("vault-kube-cloud-credentials"),
+			VaultClient:            vaultClient,
+			VaultConfig:            vaultConfig,
+		}
+
 		o, err := operator.NewAWSOperator(&operator.AWSOperatorConfig{
-			Config: &operator.Config{
-				KubeClient:            mgr.GetClient(),
-				KubernetesAuthBackend: *flagOperatorKubeAuthBackend,
-				Prefix:                *flagOperatorPrefix,
-				VaultClient:           vaultClient,
-				VaultConfig:           vaultConfig,
-			},
+			Config:     operatorConfig,
 			AWSPath:    *flagOperatorAWSBackend,
+			ConfigFile: *flagOperatorConfigFile,
 			DefaultTTL: *flagOperatorDefaultTTL,
 		})
 		if err != nil {
@@ -137,8 +324,29 @@ func main() {
 			os.Exit(1)
 		}
 
+		gcpOperator, err := operator.NewGCPOperator(&operator.GCPOperatorConfig{
+			Config:  operatorConfig,
+			GCPPath: *flagOperatorGCPBackend,
+		})
+		if err != nil {
+			log.Error(err, "error creating gcp operator")
+			os.Exit(1)
+		}
+
+		// The file is read once, so that the operators load the same
+		// content and the watcher detects any change made after it
+		var configData []byte
 		if *flagOperatorConfigFile != "" {
-			if err := o.LoadConfig(*flagOperatorConfigFile); err != nil {
+			configData, err = ioutil.ReadFile(*flagOperatorConfigFile)
+			if err != nil {
+				log.Error(err, "error reading configuration file")
+				os.Exit(1)
+			}
+			if err := o.LoadConfig(configData); err != nil {
+				log.Error(err, "error loading configuration file")
+				os.Exit(1)
+			}
+			if err := gcpOperator.LoadConfig(configData); err != nil {
 				log.Error(err, "error loading configuration file")
 				os.Exit(1)
 			}
@@ -149,6 +357,40 @@ func main() {
 			os.Exit(1)
 		}
 
+		if *flagOperatorWebhookPort > 0 {
+			if err = o.SetupWebhookWithManager(mgr); err != nil {
+				log.Error(err, "error creating webhook")
+				os.Exit(1)
+			}
+		}
+
+		// The GCP operator is only enabled when there's a gcp section in
+		// the config file
+		if gcpOperator.Enabled() {
+			if err = gcpOperator.SetupWithManager(mgr); err != nil {
+				log.Error(err, "error creating gcp controller")
+				os.Exit(1)
+			}
+		}
+
+		// The rules are reloaded when the config file changes, for
+		// each of the operators that are enabled
+		if *flagOperatorConfigFile != "" && *flagOperatorConfigReload > 0 {
+			watcher := &operator.ConfigWatcher{
+				Data:      configData,
+				File:      *flagOperatorConfigFile,
+				Interval:  *flagOperatorConfigReload,
+				Operators: []operator.ConfigReloader{o},
+			}
+			if gcpOperator.Enabled() {
+				watcher.Operators = append(watcher.Operators, gcpOperator)
+			}
+			if err := mgr.Add(watcher); err != nil {
+				log.Error(err, "error adding config watcher")
+				os.Exit(1)
+			}
+		}
+
 		if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
 			log.Error(err, "error running manager")
 			os.Exit(1)
@@ -168,6 +410,7 @@ func main() {
 			log.Error(err, "error reading token from file", "file", *flagAWSKubeTokenPath)
 			os.Exit(1)
 		}
+		log.Info("read service account token", "namespace", tokenClaims.Namespace, "serviceaccount", tokenClaims.ServiceAccountName, "pod", tokenClaims.PodName, "pod_uid", tokenClaims.PodUID)
 
 		kubeAuthRole := *flagAWSKubeAuthRole
 		if kubeAuthRole == "" {
@@ -179,15 +422,56 @@ func main() {
 			awsRole = *flagAWSPrefix + "_aws_" + tokenClaims.Namespace + "_" + tokenClaims.ServiceAccountName
 		}
 
+		if err := checkAWSIMDS(*flagAWSIMDS, *flagAWSAuthTokenFile); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		var authorizationToken string
+		if *flagAWSAuthTokenFile != "" {
+			authorizationToken, err = sidecar.ReadOrCreateAWSAuthorizationToken(*flagAWSAuthTokenFile)
+			if err != nil {
+				log.Error(err, "error reading authorization token", "file", *flagAWSAuthTokenFile)
+				os.Exit(1)
+			}
+		}
+
+		if err := checkAWSCredentialType(*flagAWSCredType, *flagAWSRoleArn, len(flagAWSProfileRoles.names) > 0); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		if _, ok := flagAWSProfileRoles.roleArns[*flagAWSProfile]; ok {
+			fmt.Printf("-profile-role-arn must not use the name of the default profile: %s\n", *flagAWSProfile)
+			os.Exit(1)
+		}
+
+		if !*flagAWSOnce && *flagAWSListenAddr == "" && *flagAWSCredsFile == "" {
+			fmt.Println("at least one of -listen-address or -credentials-file must be set")
+			os.Exit(1)
+		}
+
 		sidecarConfig := &sidecar.Config{
-			KubeAuthPath:  *flagAWSKubeBackend,
-			KubeAuthRole:  kubeAuthRole,
-			ListenAddress: *flagAWSListenAddr,
-			OpsAddress:    *flagAWSOpsAddr,
+			CredentialsFile:   *flagAWSCredsFile,
+			CredentialsFormat: *flagAWSCredsFormat,
+			ExpiryMargin:      *flagAWSExpiryMargin,
+			KubeAuthPath:      *flagAWSKubeBackend,
+			KubeAuthRole:      kubeAuthRole,
+			ListenAddress:     *flagAWSListenAddr,
+			OpsAddress:        *flagAWSOpsAddr,
+			RevokeOnShutdown:  *flagAWSRevoke,
+			ShutdownTimeout:   *flagAWSShutdownTO,
 			ProviderConfig: &sidecar.AWSProviderConfig{
-				Path:    *flagAWSBackend,
-				RoleArn: *flagAWSRoleArn,
-				Role:    awsRole,
+				Path:               *flagAWSBackend,
+				RoleArn:            *flagAWSRoleArn,
+				Role:               awsRole,
+				CredentialType:     *flagAWSCredType,
+				Roles:              flagAWSProfileRoles.roles(awsRole),
+				IMDS:               *flagAWSIMDS,
+				IMDSv2Required:     *flagAWSIMDSv2,
+				Region:             *flagAWSRegion,
+				AuthorizationToken: authorizationToken,
+				Profile:            *flagAWSProfile,
 			},
 			TokenPath: *flagAWSKubeTokenPath,
 		}
@@ -198,6 +482,14 @@ func main() {
 			os.Exit(1)
 		}
 
+		if *flagAWSOnce {
+			if err := s.RunOnce(os.Stdout); err != nil {
+				log.Error(err, "error retrieving credentials")
+				os.Exit(onceExitCode(err))
+			}
+			return
+		}
+
 		if err := s.Run(); err != nil {
 			log.Error(err, "error running sidecar")
 			os.Exit(1)
@@ -206,6 +498,78 @@ func main() {
 		return
 	}
 
+	if awsCredentialProcessCommand.Parsed() {
+		if len(awsCredentialProcessCommand.Args()) > 0 {
+			awsCredentialProcessCommand.PrintDefaults()
+			os.Exit(1)
+		}
+
+		// Avoid logging in to vault by retrieving the credentials from
+		// a sidecar
+		if *flagAWSCPSidecarURL != "" {
+			var authorizationToken string
+			if *flagAWSCPAuthTokenFile != "" {
+				data, err := ioutil.ReadFile(*flagAWSCPAuthTokenFile)
+				if err != nil {
+					log.Error(err, "error reading authorization token", "file", *flagAWSCPAuthTokenFile)
+					os.Exit(1)
+				}
+				authorizationToken = strings.TrimSpace(string(data))
+			}
+
+			if err := sidecar.AWSCredentialProcessFromSidecar(*flagAWSCPSidecarURL, authorizationToken, os.Stdout); err != nil {
+				log.Error(err, "error retrieving credentials from sidecar", "url", *flagAWSCPSidecarURL)
+				os.Exit(1)
+			}
+
+			return
+		}
+
+		if err := checkAWSCredentialType(*flagAWSCPCredType, *flagAWSCPRoleArn, false); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		tokenClaims, err := newKubeTokenClaimsFromFile(*flagAWSCPKubeTokenPath)
+		if err != nil {
+			log.Error(err, "error reading token from file", "file", *flagAWSCPKubeTokenPath)
+			os.Exit(1)
+		}
+
+		kubeAuthRole := *flagAWSCPKubeAuthRole
+		if kubeAuthRole == "" {
+			kubeAuthRole = *flagAWSCPPrefix + "_aws_" + tokenClaims.Namespace + "_" + tokenClaims.ServiceAccountName
+		}
+
+		awsRole := *flagAWSCPRole
+		if awsRole == "" {
+			awsRole = *flagAWSCPPrefix + "_aws_" + tokenClaims.Namespace + "_" + tokenClaims.ServiceAccountName
+		}
+
+		s, err := sidecar.New(&sidecar.Config{
+			KubeAuthPath: *flagAWSCPKubeBackend,
+			KubeAuthRole: kubeAuthRole,
+			ProviderConfig: &sidecar.AWSProviderConfig{
+				Path:           *flagAWSCPBackend,
+				RoleArn:        *flagAWSCPRoleArn,
+				Role:           awsRole,
+				CredentialType: *flagAWSCPCredType,
+			},
+			TokenPath: *flagAWSCPKubeTokenPath,
+		})
+		if err != nil {
+			log.Error(err, "error creating sidecar")
+			os.Exit(1)
+		}
+
+		if err := s.AWSCredentialProcess(os.Stdout); err != nil {
+			log.Error(err, "error retrieving credentials")
+			os.Exit(1)
+		}
+
+		return
+	}
+
 	if gcpSidecarCommand.Parsed() {
 		if len(gcpSidecarCommand.Args()) > 0 {
 			gcpSidecarCommand.PrintDefaults()
@@ -217,6 +581,7 @@ func main() {
 			log.Error(err, "error reading token from file", "file", *flagGCPKubeTokenPath)
 			os.Exit(1)
 		}
+		log.Info("read service account token", "namespace", tokenClaims.Namespace, "serviceaccount", tokenClaims.ServiceAccountName, "pod", tokenClaims.PodName, "pod_uid", tokenClaims.PodUID)
 
 		kubeAuthRole := *flagGCPKubeAuthRole
 		if kubeAuthRole == "" {
@@ -228,11 +593,21 @@ func main() {
 			gcpRoleSet = *flagGCPPrefix + "_gcp_" + tokenClaims.Namespace + "_" + tokenClaims.ServiceAccountName
 		}
 
+		if !*flagGCPOnce && *flagGCPListenAddr == "" && *flagGCPCredsFile == "" {
+			fmt.Println("at least one of -listen-address or -credentials-file must be set")
+			os.Exit(1)
+		}
+
 		sidecarConfig := &sidecar.Config{
-			KubeAuthPath:  *flagGCPKubeBackend,
-			KubeAuthRole:  kubeAuthRole,
-			ListenAddress: *flagGCPListenAddr,
-			OpsAddress:    *flagGCPOpsAddr,
+			CredentialsFile:   *flagGCPCredsFile,
+			CredentialsFormat: *flagGCPCredsFormat,
+			ExpiryMargin:      *flagGCPExpiryMargin,
+			KubeAuthPath:      *flagGCPKubeBackend,
+			KubeAuthRole:      kubeAuthRole,
+			ListenAddress:     *flagGCPListenAddr,
+			OpsAddress:        *flagGCPOpsAddr,
+			RevokeOnShutdown:  *flagGCPRevoke,
+			ShutdownTimeout:   *flagGCPShutdownTO,
 			ProviderConfig: &sidecar.GCPProviderConfig{
 				Path:    *flagGCPBackend,
 				RoleSet: gcpRoleSet,
@@ -246,6 +621,14 @@ func main() {
 			os.Exit(1)
 		}
 
+		if *flagGCPOnce {
+			if err := s.RunOnce(os.Stdout); err != nil {
+				log.Error(err, "error retrieving credentials")
+				os.Exit(onceExitCode(err))
+			}
+			return
+		}
+
 		if err := s.Run(); err != nil {
 			log.Error(err, "error running sidecar")
 			os.Exit(1)
@@ -254,6 +637,116 @@ func main() {
 		return
 	}
 
+	if awsExecCommand.Parsed() {
+		if len(awsExecCommand.Args()) == 0 {
+			awsExecCommand.PrintDefaults()
+			os.Exit(1)
+		}
+
+		if err := checkAWSCredentialType(*flagAWSExecCredType, *flagAWSExecRoleArn, false); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		tokenClaims, err := newKubeTokenClaimsFromFile(*flagAWSExecKubeToken)
+		if err != nil {
+			log.Error(err, "error reading token from file", "file", *flagAWSExecKubeToken)
+			os.Exit(1)
+		}
+
+		kubeAuthRole := *flagAWSExecKubeAuthRole
+		if kubeAuthRole == "" {
+			kubeAuthRole = *flagAWSExecPrefix + "_aws_" + tokenClaims.Namespace + "_" + tokenClaims.ServiceAccountName
+		}
+
+		awsRole := *flagAWSExecRole
+		if awsRole == "" {
+			awsRole = *flagAWSExecPrefix + "_aws_" + tokenClaims.Namespace + "_" + tokenClaims.ServiceAccountName
+		}
+
+		// The token is passed to the child in its environment, so it
+		// doesn't need to be written anywhere
+		authorizationToken, err := sidecar.GenerateAWSAuthorizationToken()
+		if err != nil {
+			log.Error(err, "error generating authorization token")
+			os.Exit(1)
+		}
+
+		s, err := sidecar.New(&sidecar.Config{
+			ExpiryMargin:     *flagAWSExecExpiryMargin,
+			KubeAuthPath:     *flagAWSExecKubeBackend,
+			KubeAuthRole:     kubeAuthRole,
+			OpsAddress:       *flagAWSExecOpsAddr,
+			RevokeOnShutdown: *flagAWSExecRevoke,
+			ProviderConfig: &sidecar.AWSProviderConfig{
+				Path:               *flagAWSExecBackend,
+				RoleArn:            *flagAWSExecRoleArn,
+				Role:               awsRole,
+				CredentialType:     *flagAWSExecCredType,
+				AuthorizationToken: authorizationToken,
+			},
+			TokenPath: *flagAWSExecKubeToken,
+		})
+		if err != nil {
+			log.Error(err, "error creating sidecar")
+			os.Exit(1)
+		}
+
+		args := awsExecCommand.Args()
+		code, err := s.Exec(context.Background(), args[0], args[1:])
+		if err != nil {
+			log.Error(err, "error running command", "command", args[0])
+		}
+		os.Exit(code)
+	}
+
+	if gcpExecCommand.Parsed() {
+		if len(gcpExecCommand.Args()) == 0 {
+			gcpExecCommand.PrintDefaults()
+			os.Exit(1)
+		}
+
+		tokenClaims, err := newKubeTokenClaimsFromFile(*flagGCPExecKubeToken)
+		if err != nil {
+			log.Error(err, "error reading token from file", "file", *flagGCPExecKubeToken)
+			os.Exit(1)
+		}
+
+		kubeAuthRole := *flagGCPExecKubeAuthRole
+		if kubeAuthRole == "" {
+			kubeAuthRole = *flagGCPExecPrefix + "_gcp_" + tokenClaims.Namespace + "_" + tokenClaims.ServiceAccountName
+		}
+
+		gcpRoleSet := *flagGCPExecRoleSet
+		if gcpRoleSet == "" {
+			gcpRoleSet = *flagGCPExecPrefix + "_gcp_" + tokenClaims.Namespace + "_" + tokenClaims.ServiceAccountName
+		}
+
+		s, err := sidecar.New(&sidecar.Config{
+			ExpiryMargin:     *flagGCPExecExpiryMargin,
+			KubeAuthPath:     *flagGCPExecKubeBackend,
+			KubeAuthRole:     kubeAuthRole,
+			OpsAddress:       *flagGCPExecOpsAddr,
+			RevokeOnShutdown: *flagGCPExecRevoke,
+			ProviderConfig: &sidecar.GCPProviderConfig{
+				Path:    *flagGCPExecBackend,
+				RoleSet: gcpRoleSet,
+			},
+			TokenPath: *flagGCPExecKubeToken,
+		})
+		if err != nil {
+			log.Error(err, "error creating sidecar")
+			os.Exit(1)
+		}
+
+		args := gcpExecCommand.Args()
+		code, err := s.Exec(context.Background(), args[0], args[1:])
+		if err != nil {
+			log.Error(err, "error running command", "command", args[0])
+		}
+		os.Exit(code)
+	}
+
 	usage()
 	return
 }
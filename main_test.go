@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/utilitywarehouse/vault-kube-cloud-credentials/sidecar"
+)
+
+func TestCheckAWSIMDS(t *testing.T) {
+	assert.NoError(t, checkAWSIMDS(false, ""))
+	assert.NoError(t, checkAWSIMDS(true, ""))
+	assert.NoError(t, checkAWSIMDS(false, "/var/run/vkcc/token"))
+	assert.Error(t, checkAWSIMDS(true, "/var/run/vkcc/token"))
+}
+
+func TestOnceExitCode(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		code int
+	}{
+		{fmt.Errorf("%w: permission denied", sidecar.ErrLogin), 2},
+		{fmt.Errorf("%w: permission denied", sidecar.ErrCredentials), 3},
+		{fmt.Errorf("%w: no such file or directory", sidecar.ErrOutput), 4},
+		{errors.New("unknown"), 1},
+	} {
+		assert.Equal(t, tc.code, onceExitCode(tc.err), tc.err.Error())
+	}
+}
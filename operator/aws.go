@@ -3,30 +3,74 @@ package operator
 import (
 	"bytes"
 	"context"
-	"io/ioutil"
+	"encoding/json"
+	"fmt"
+	"reflect"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws/arn"
 	"github.com/go-logr/logr"
+	"github.com/utilitywarehouse/vault-kube-cloud-credentials/api/v1alpha1"
 	"gopkg.in/yaml.v2"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
 	"text/template"
 
 	// Enables all auth methods for the kube client
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
 const (
-	awsRoleAnnotation = "vault.uw.systems/aws-role"
+	awsRoleAnnotation           = "vault.uw.systems/aws-role"
+	awsSTSTTLAnnotation         = "vault.uw.systems/aws-sts-ttl"
+	awsMaxSTSTTLAnnotation      = "vault.uw.systems/aws-max-sts-ttl"
+	awsPolicyDocumentAnnotation = "vault.uw.systems/aws-policy-document"
+	awsPolicyArnsAnnotation     = "vault.uw.systems/aws-policy-arns"
+	awsIAMGroupsAnnotation      = "vault.uw.systems/aws-iam-groups"
+	awsCredentialTypeAnnotation = "vault.uw.systems/aws-credential-type"
+	// awsStatusAnnotation is written by the operator with the outcome of
+	// the last reconciliation
+	awsStatusAnnotation = "vault.uw.systems/aws-status"
 )
 
+// The types of credentials that the aws secret role can issue
+const (
+	awsCredentialTypeAssumedRole     = "assumed_role"
+	awsCredentialTypeFederationToken = "federation_token"
+	awsCredentialTypeIAMUser         = "iam_user"
+)
+
+// The effects of aws rules
+const (
+	awsRuleEffectAllow = "allow"
+	awsRuleEffectDeny  = "deny"
+)
+
+// awsAnnotations are the annotations that configure the aws secret role
+var awsAnnotations = []string{
+	awsRoleAnnotation,
+	awsSTSTTLAnnotation,
+	awsMaxSTSTTLAnnotation,
+	awsPolicyDocumentAnnotation,
+	awsPolicyArnsAnnotation,
+	awsIAMGroupsAnnotation,
+	awsCredentialTypeAnnotation,
+}
+
 var awsPolicyTemplate = `
 path "{{ .AWSPath }}/creds/{{ .Name }}" {
   capabilities = ["create", "read", "update", "delete", "list"]
@@ -34,8 +78,48 @@ path "{{ .AWSPath }}/creds/{{ .Name }}" {
 path "{{ .AWSPath }}/sts/{{ .Name }}" {
   capabilities = ["create", "read", "update", "delete", "list"]
 }
+path "sys/leases/revoke/{{ .AWSPath }}/creds/{{ .Name }}/*" {
+  capabilities = ["update"]
+}
+path "sys/leases/revoke/{{ .AWSPath }}/sts/{{ .Name }}/*" {
+  capabilities = ["update"]
+}
 `
 
+// awsStatus is the outcome of the last reconciliation of a service account,
+// written to the status annotation as json so that it's visible in
+// `kubectl describe`
+type awsStatus struct {
+	VaultRole    string    `json:"vaultRole,omitempty"`
+	LastSyncTime time.Time `json:"lastSyncTime"`
+	Reason       string    `json:"reason"`
+	Message      string    `json:"message,omitempty"`
+}
+
+// hasAWSAnnotations returns true if any of the annotations that configure the
+// aws secret role are present, valid or not
+func hasAWSAnnotations(annotations map[string]string) bool {
+	for _, a := range awsAnnotations {
+		if _, ok := annotations[a]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// awsAnnotationsChanged returns true if any of the annotations that configure
+// the aws secret role are different
+func awsAnnotationsChanged(old, new map[string]string) bool {
+	for _, a := range awsAnnotations {
+		if old[a] != new[a] {
+			return true
+		}
+	}
+
+	return false
+}
+
 // awsFileConfig configures the AWS operator
 type awsFileConfig struct {
 	AWS struct {
@@ -46,42 +130,327 @@ type awsFileConfig struct {
 // AWSRules are a collection of rules.
 type AWSRules []AWSRule
 
-// allow returns true if there is a rule in the list of rules which allows
-// a service account in the given namespace to assume the given role. Rules are
-// evaluated in order and allow returns true for the first matching rule in the
-// list
-func (ar AWSRules) allow(namespace, roleArn string) (bool, error) {
+// validate returns an error if any of the rules are invalid
+func (ar AWSRules) validate() error {
+	for i, rule := range ar {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("aws rule %d: %v", i, err)
+		}
+	}
+
+	return nil
+}
+
+// allow returns true if the rules allow a service account in the given
+// namespace to assume the given role
+func (ar AWSRules) allow(namespace string, namespaceLabels map[string]string, roleArn string) (bool, error) {
+	_, allowed, err := ar.match(namespace, namespaceLabels, roleArn)
+
+	return allowed, err
+}
+
+// match returns the rule that decides whether a service account in the given
+// namespace, with the given labels, can assume the given role, and whether the
+// role is allowed. Any role is allowed if there aren't any rules.
+func (ar AWSRules) match(namespace string, namespaceLabels map[string]string, roleArn string) (*AWSRule, bool, error) {
 	a, err := arn.Parse(roleArn)
 	if err != nil {
-		return false, err
+		return nil, false, err
 	}
 
-	for _, r := range ar {
-		allowed, err := r.allows(namespace, a)
-		if err != nil {
+	if len(ar) == 0 {
+		return nil, true, nil
+	}
+
+	return ar.decide(func(rule *AWSRule) (bool, error) {
+		return rule.matchesRole(namespace, namespaceLabels, a)
+	})
+}
+
+// matchCredentialType returns the rule that decides whether a service account
+// in the given namespace can have credentials of the type in the settings,
+// which isn't an assumed role, with the policies in the settings, and whether
+// they're allowed. They're only allowed by an allow rule that lists the type,
+// so they aren't allowed if there aren't any rules.
+func (ar AWSRules) matchCredentialType(namespace string, namespaceLabels map[string]string, settings *awsRoleSettings) (*AWSRule, bool, error) {
+	return ar.decide(func(rule *AWSRule) (bool, error) {
+		namespaceAllowed, err := rule.matchesNamespace(namespace, namespaceLabels)
+		if err != nil || !namespaceAllowed || !rule.matchesCredentialType(settings.credentialType) {
 			return false, err
 		}
-		if allowed {
-			return true, nil
+
+		return rule.matchesPolicies(settings)
+	})
+}
+
+// decide returns the rule that decides the outcome for the rules that match,
+// and whether it's allowed. A matching deny rule takes precedence over the
+// allow rules, wherever it is in the list. Otherwise, the first matching
+// allow rule allows it. The rule is nil if none of the rules match, in which
+// case it isn't allowed.
+func (ar AWSRules) decide(matches func(*AWSRule) (bool, error)) (*AWSRule, bool, error) {
+	var allowRule *AWSRule
+	for i := range ar {
+		deny, err := ar[i].denies()
+		if err != nil {
+			return nil, false, err
+		}
+
+		match, err := matches(&ar[i])
+		if err != nil {
+			return nil, false, err
+		}
+		if !match {
+			continue
+		}
+
+		if deny {
+			return &ar[i], false, nil
+		}
+		if allowRule == nil {
+			allowRule = &ar[i]
+		}
+	}
+
+	if allowRule != nil {
+		return allowRule, true, nil
+	}
+
+	return nil, false, nil
+}
+
+// selectsNamespaces returns true if any of the rules select namespaces by
+// their labels
+func (ar AWSRules) selectsNamespaces() bool {
+	for _, rule := range ar {
+		if rule.NamespaceSelector != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseAWSList parses the value of an annotation that is a comma separated
+// list, like the role arns in the aws-role annotation
+func parseAWSList(value string) []string {
+	list := []string{}
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+
+	return list
+}
+
+// parseAWSTTL parses the value of a ttl annotation, returning 0 if it's
+// empty
+func parseAWSTTL(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	ttl, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if ttl <= 0 {
+		return 0, fmt.Errorf("ttl must be positive: %s", value)
+	}
+
+	return ttl, nil
+}
+
+// awsRoleSettings are the settings for the aws secret role, parsed from the
+// annotations on a service account
+type awsRoleSettings struct {
+	credentialType string
+	roleArns       []string
+	stsTTL         time.Duration
+	maxSTSTTL      time.Duration
+	policyDocument string
+	policyArns     []string
+	iamGroups      []string
+	// permittedBy describes the rules that permitted the settings
+	permittedBy []string
+}
+
+// parseAWSRoleSettings parses and validates the annotations on a service
+// account
+func parseAWSRoleSettings(annotations map[string]string) (*awsRoleSettings, error) {
+	settings := &awsRoleSettings{
+		credentialType: annotations[awsCredentialTypeAnnotation],
+		roleArns:       parseAWSList(annotations[awsRoleAnnotation]),
+		policyDocument: annotations[awsPolicyDocumentAnnotation],
+		policyArns:     parseAWSList(annotations[awsPolicyArnsAnnotation]),
+		iamGroups:      parseAWSList(annotations[awsIAMGroupsAnnotation]),
+	}
+	if settings.credentialType == "" {
+		settings.credentialType = awsCredentialTypeAssumedRole
+	}
+
+	// Assumed roles are permitted by the role arns, the other types by
+	// the policies attached to the user
+	switch settings.credentialType {
+	case awsCredentialTypeAssumedRole:
+		if len(settings.roleArns) == 0 {
+			return nil, fmt.Errorf("no role arns specified")
+		}
+	case awsCredentialTypeFederationToken, awsCredentialTypeIAMUser:
+		if len(settings.roleArns) > 0 {
+			return nil, fmt.Errorf("role arns can only be specified for %s credentials", awsCredentialTypeAssumedRole)
+		}
+		if settings.policyDocument == "" && len(settings.policyArns) == 0 && len(settings.iamGroups) == 0 {
+			return nil, fmt.Errorf("%s credentials require a policy document, policy arns or iam groups", settings.credentialType)
+		}
+	default:
+		return nil, fmt.Errorf("invalid %s annotation: unsupported credential type: %s", awsCredentialTypeAnnotation, settings.credentialType)
+	}
+
+	var err error
+	if settings.stsTTL, err = parseAWSTTL(annotations[awsSTSTTLAnnotation]); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %v", awsSTSTTLAnnotation, err)
+	}
+	if settings.maxSTSTTL, err = parseAWSTTL(annotations[awsMaxSTSTTLAnnotation]); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %v", awsMaxSTSTTLAnnotation, err)
+	}
+	if settings.maxSTSTTL > 0 && settings.stsTTL > settings.maxSTSTTL {
+		return nil, fmt.Errorf("sts ttl %s exceeds the max sts ttl %s", settings.stsTTL, settings.maxSTSTTL)
+	}
+	if settings.credentialType == awsCredentialTypeIAMUser && (settings.stsTTL > 0 || settings.maxSTSTTL > 0) {
+		return nil, fmt.Errorf("sts ttls can't be specified for %s credentials", awsCredentialTypeIAMUser)
+	}
+
+	if settings.policyDocument != "" && !json.Valid([]byte(settings.policyDocument)) {
+		return nil, fmt.Errorf("invalid %s annotation: policy document is not valid json", awsPolicyDocumentAnnotation)
+	}
+
+	for _, policyArn := range settings.policyArns {
+		if _, err := arn.Parse(policyArn); err != nil {
+			return nil, fmt.Errorf("invalid %s annotation: %v", awsPolicyArnsAnnotation, err)
 		}
 	}
 
-	return len(ar) == 0, nil
+	return settings, nil
 }
 
 // AWSRule restricts the arns that a service account can assume based on
 // patterns which match its namespace to an arn or arns
 type AWSRule struct {
+	// Name identifies the rule in logs and events. Rules are identified
+	// by their position if they don't have a name.
+	Name string `yaml:"name"`
+	// Effect is either allow (default) or deny. Deny rules take
+	// precedence over allow rules.
+	Effect            string   `yaml:"effect"`
 	NamespacePatterns []string `yaml:"namespacePatterns"`
-	RoleNamePatterns  []string `yaml:"roleNamePatterns"`
-	AccountIDs        []string `yaml:"accountIDs"`
+	// NamespaceSelector selects namespaces by their labels. If it's set
+	// along with NamespacePatterns then a namespace must match both.
+	NamespaceSelector *LabelSelector `yaml:"namespaceSelector"`
+	// RoleNamePatterns match role names, including their path. A **
+	// element matches any number of path elements.
+	RoleNamePatterns []string `yaml:"roleNamePatterns"`
+	// RoleNameRegexps are regular expressions that match the whole role
+	// name, including its path
+	RoleNameRegexps []string `yaml:"roleNameRegexps"`
+	AccountIDs      []string `yaml:"accountIDs"`
+	// MaxTTL is the upper bound for the sts ttls of the roles allowed by
+	// this rule. Zero means that it's unbounded.
+	MaxTTL time.Duration `yaml:"maxTTL"`
+	// CredentialTypes are the types of credentials that the rule allows,
+	// defaulting to assumed_role. The federation_token and iam_user types
+	// are allowed for every service account in the matching namespaces,
+	// with the policies permitted by PolicyArnPatterns, IAMGroupPatterns
+	// and AllowPolicyDocument.
+	CredentialTypes []string `yaml:"credentialTypes"`
+	// PolicyArnPatterns match the policy arns that can be attached to
+	// federation_token and iam_user credentials. A ** element matches
+	// any number of path elements. A deny rule denies the policy arns
+	// that they match instead.
+	PolicyArnPatterns []string `yaml:"policyArnPatterns"`
+	// IAMGroupPatterns match the iam groups that federation_token and
+	// iam_user credentials can be given, or that a deny rule denies
+	IAMGroupPatterns []string `yaml:"iamGroupPatterns"`
+	// AllowPolicyDocument allows federation_token and iam_user
+	// credentials to have an inline policy document. A deny rule denies
+	// credentials with a policy document instead.
+	AllowPolicyDocument bool `yaml:"allowPolicyDocument"`
+
+	// source identifies the rule when it doesn't have a name
+	source string
 }
 
-// allows checks whether this rule allows a namespace to assume the given role_arn
-func (ar *AWSRule) allows(namespace string, roleArn arn.ARN) (bool, error) {
+// description identifies the rule in logs and events
+func (ar *AWSRule) description() string {
+	if ar.Name != "" {
+		return ar.Name
+	}
+	if ar.source != "" {
+		return ar.source
+	}
+
+	return "unnamed rule"
+}
+
+// denies returns true if the rule denies the roles it matches, rather than
+// allowing them
+func (ar *AWSRule) denies() (bool, error) {
+	switch ar.Effect {
+	case "", awsRuleEffectAllow:
+		return false, nil
+	case awsRuleEffectDeny:
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown effect in %s: %s", ar.description(), ar.Effect)
+	}
+}
+
+// validate returns an error if the patterns are malformed or the effect or
+// credential types aren't known
+func (ar *AWSRule) validate() error {
+	if _, err := ar.denies(); err != nil {
+		return err
+	}
+	if err := validatePatterns(ar.NamespacePatterns); err != nil {
+		return err
+	}
+	if ar.NamespaceSelector != nil {
+		if _, err := ar.NamespaceSelector.selector(); err != nil {
+			return err
+		}
+	}
+	if err := validatePatterns(ar.RoleNamePatterns); err != nil {
+		return err
+	}
+	for _, re := range ar.RoleNameRegexps {
+		if _, err := compileRoleNameRegexp(re); err != nil {
+			return err
+		}
+	}
+	if err := validatePatterns(ar.PolicyArnPatterns); err != nil {
+		return err
+	}
+	if err := validatePatterns(ar.IAMGroupPatterns); err != nil {
+		return err
+	}
+	for _, ct := range ar.CredentialTypes {
+		switch ct {
+		case awsCredentialTypeAssumedRole, awsCredentialTypeFederationToken, awsCredentialTypeIAMUser:
+		default:
+			return fmt.Errorf("unknown credential type: %s", ct)
+		}
+	}
+
+	return nil
+}
+
+// matchesRole checks whether this rule matches a namespace and the given
+// role_arn, which it either allows or denies
+func (ar *AWSRule) matchesRole(namespace string, namespaceLabels map[string]string, roleArn arn.ARN) (bool, error) {
 	accountIDAllowed := ar.matchesAccountID(roleArn.AccountID)
 
-	namespaceAllowed, err := ar.matchesNamespace(namespace)
+	namespaceAllowed, err := ar.matchesNamespace(namespace, namespaceLabels)
 	if err != nil {
 		return false, err
 	}
@@ -94,7 +463,73 @@ func (ar *AWSRule) allows(namespace string, roleArn arn.ARN) (bool, error) {
 		}
 	}
 
-	return accountIDAllowed && namespaceAllowed && roleAllowed, nil
+	return accountIDAllowed && namespaceAllowed && roleAllowed && ar.matchesCredentialType(awsCredentialTypeAssumedRole), nil
+}
+
+// matchesCredentialType returns true if the rule allows the given type of
+// credentials. Only assumed roles are allowed if the rule doesn't list any
+// types.
+func (ar *AWSRule) matchesCredentialType(credentialType string) bool {
+	for _, ct := range ar.CredentialTypes {
+		if ct == credentialType {
+			return true
+		}
+	}
+
+	return len(ar.CredentialTypes) == 0 && credentialType == awsCredentialTypeAssumedRole
+}
+
+// matchesPolicies returns true if the rule matches the policies of
+// credentials that aren't assumed roles. An allow rule matches if it permits
+// every policy arn and iam group, and the policy document if there is one. A
+// deny rule matches if it lists any of them, or if it doesn't list any
+// policies at all.
+func (ar *AWSRule) matchesPolicies(settings *awsRoleSettings) (bool, error) {
+	deny, err := ar.denies()
+	if err != nil {
+		return false, err
+	}
+	if deny && len(ar.PolicyArnPatterns) == 0 && len(ar.IAMGroupPatterns) == 0 && !ar.AllowPolicyDocument {
+		return true, nil
+	}
+
+	if settings.policyDocument != "" && ar.AllowPolicyDocument == deny {
+		return deny, nil
+	}
+
+	for _, policyArn := range settings.policyArns {
+		match, err := ar.matchesPolicyArn(policyArn)
+		if err != nil {
+			return false, err
+		}
+		if match == deny {
+			return deny, nil
+		}
+	}
+
+	for _, group := range settings.iamGroups {
+		match, err := matchesPatterns(ar.IAMGroupPatterns, group)
+		if err != nil {
+			return false, err
+		}
+		if match == deny {
+			return deny, nil
+		}
+	}
+
+	return !deny, nil
+}
+
+// matchesPolicyArn returns true if one of the patterns matches the policy arn
+func (ar *AWSRule) matchesPolicyArn(policyArn string) (bool, error) {
+	for _, pp := range ar.PolicyArnPatterns {
+		match, err := matchRolePath(pp, policyArn)
+		if err != nil || match {
+			return match, err
+		}
+	}
+
+	return false, nil
 }
 
 // matchesAccountID returns true if the rule allows an accountID, or if it
@@ -109,25 +544,33 @@ func (ar *AWSRule) matchesAccountID(accountID string) bool {
 	return len(ar.AccountIDs) == 0
 }
 
-// matchesNamespace returns true if the rule allows the given namespace
-func (ar *AWSRule) matchesNamespace(namespace string) (bool, error) {
-	for _, np := range ar.NamespacePatterns {
-		match, err := filepath.Match(np, namespace)
-		if err != nil {
+// matchesNamespace returns true if the rule allows the given namespace, by
+// its name and labels. A rule without patterns or a selector doesn't allow
+// any namespace.
+func (ar *AWSRule) matchesNamespace(namespace string, namespaceLabels map[string]string) (bool, error) {
+	if len(ar.NamespacePatterns) == 0 && ar.NamespaceSelector == nil {
+		return false, nil
+	}
+
+	if len(ar.NamespacePatterns) > 0 {
+		match, err := matchesPatterns(ar.NamespacePatterns, namespace)
+		if err != nil || !match {
 			return false, err
 		}
-		if match {
-			return true, nil
-		}
 	}
 
-	return false, nil
+	if ar.NamespaceSelector != nil {
+		return ar.NamespaceSelector.matches(namespaceLabels)
+	}
+
+	return true, nil
 }
 
-// matchesRoleName returns true if the rule allows the given role name
+// matchesRoleName returns true if the rule matches the given role name, by
+// its patterns or regular expressions
 func (ar *AWSRule) matchesRoleName(roleName string) (bool, error) {
 	for _, rp := range ar.RoleNamePatterns {
-		match, err := filepath.Match(rp, roleName)
+		match, err := matchRolePath(rp, roleName)
 		if err != nil {
 			return false, err
 		}
@@ -136,13 +579,77 @@ func (ar *AWSRule) matchesRoleName(roleName string) (bool, error) {
 		}
 	}
 
+	for _, re := range ar.RoleNameRegexps {
+		r, err := compileRoleNameRegexp(re)
+		if err != nil {
+			return false, err
+		}
+		if r.MatchString(roleName) {
+			return true, nil
+		}
+	}
+
 	return false, nil
 }
 
+// matchRolePath matches a role name, including its path, against a pattern.
+// A ** element in the pattern matches any number of path elements, while the
+// other elements are matched like shell file name patterns.
+func matchRolePath(pattern, roleName string) (bool, error) {
+	if !strings.Contains(pattern, "**") {
+		return filepath.Match(pattern, roleName)
+	}
+
+	return matchPathElements(strings.Split(pattern, "/"), strings.Split(roleName, "/"))
+}
+
+// matchPathElements matches the elements of a path against the elements of
+// a pattern
+func matchPathElements(pattern, path []string) (bool, error) {
+	if len(pattern) == 0 {
+		return len(path) == 0, nil
+	}
+
+	if pattern[0] == "**" {
+		for i := 0; i <= len(path); i++ {
+			match, err := matchPathElements(pattern[1:], path[i:])
+			if err != nil || match {
+				return match, err
+			}
+		}
+		return false, nil
+	}
+
+	if len(path) == 0 {
+		return false, nil
+	}
+
+	match, err := filepath.Match(pattern[0], path[0])
+	if err != nil || !match {
+		return false, err
+	}
+
+	return matchPathElements(pattern[1:], path[1:])
+}
+
+// compileRoleNameRegexp compiles a regular expression that matches the whole
+// role name
+func compileRoleNameRegexp(re string) (*regexp.Regexp, error) {
+	r, err := regexp.Compile("^(?:" + re + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid role name regexp: %v", err)
+	}
+
+	return r, nil
+}
+
 // AWSOperatorConfig provides configuration when creating a new Operator
 type AWSOperatorConfig struct {
 	*Config
-	AWSPath    string
+	AWSPath string
+	// ConfigFile is the path of the config file that the rules are loaded
+	// from, which is named in messages that explain a denial
+	ConfigFile string
 	DefaultTTL time.Duration
 }
 
@@ -150,9 +657,14 @@ type AWSOperatorConfig struct {
 // roles based on ServiceAccount annotations
 type AWSOperator struct {
 	*AWSOperatorConfig
-	log   logr.Logger
+	log logr.Logger
+	// mu guards the rules, which are replaced when the config file is
+	// reloaded
+	mu    sync.RWMutex
 	rules AWSRules
-	tmpl  *template.Template
+	// reconcileEvents are sent to reconcile service accounts again
+	reconcileEvents chan event.GenericEvent
+	tmpl            *template.Template
 }
 
 // NewAWSOperator returns a configured AWSOperator
@@ -171,24 +683,191 @@ func NewAWSOperator(config *AWSOperatorConfig) (*AWSOperator, error) {
 	return ar, nil
 }
 
-// LoadConfig loads configuration from a file
-func (o *AWSOperator) LoadConfig(file string) error {
-	afc := &awsFileConfig{}
-
-	data, err := ioutil.ReadFile(file)
+// LoadConfig loads configuration from the content of the config file
+func (o *AWSOperator) LoadConfig(data []byte) error {
+	rules, err := parseAWSConfig(data)
 	if err != nil {
 		return err
 	}
 
-	if err := yaml.Unmarshal(data, afc); err != nil {
+	o.mu.Lock()
+	o.rules = rules
+	o.mu.Unlock()
+
+	return nil
+}
+
+// ReloadConfig replaces the rules with the rules in the content of the config
+// file, if they're valid. If the rules have changed then every service
+// account is reconciled again, so that roles that are no longer permitted are
+// removed from vault and newly permitted roles are written.
+func (o *AWSOperator) ReloadConfig(data []byte) error {
+	rules, err := parseAWSConfig(data)
+	if err != nil {
 		return err
 	}
 
-	o.rules = afc.AWS.Rules
+	o.mu.Lock()
+	previous := o.rules
+	o.rules = rules
+	o.mu.Unlock()
+
+	if !logRuleChanges(o.log, previous, rules) {
+		return nil
+	}
+
+	requests, err := o.serviceAccountRequests(context.Background(), hasAWSAnnotations, awsBinding, func(string) bool {
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	requeue(o.reconcileEvents, requests)
 
 	return nil
 }
 
+// parseAWSConfig returns the aws rules in the content of a config file,
+// after validating them
+func parseAWSConfig(data []byte) (AWSRules, error) {
+	afc := &awsFileConfig{}
+	if err := yaml.Unmarshal(data, afc); err != nil {
+		return nil, err
+	}
+
+	if err := afc.AWS.Rules.validate(); err != nil {
+		return nil, err
+	}
+
+	for i := range afc.AWS.Rules {
+		afc.AWS.Rules[i].source = fmt.Sprintf("aws.rules[%d]", i)
+	}
+
+	return afc.AWS.Rules, nil
+}
+
+// currentRules returns the rules from the config file, followed by the rules
+// from the policies, if they're enabled
+func (o *AWSOperator) currentRules(ctx context.Context) (AWSRules, error) {
+	policies, err := o.credentialPolicies(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	o.mu.RLock()
+	rules := append(AWSRules{}, o.rules...)
+	o.mu.RUnlock()
+	for i := range policies {
+		rules = append(rules, awsPolicyRules(&policies[i])...)
+	}
+
+	return rules, nil
+}
+
+// awsPolicyRules returns the aws rules in a policy
+func awsPolicyRules(p *v1alpha1.CloudCredentialPolicy) AWSRules {
+	if p.Spec.AWS == nil {
+		return nil
+	}
+
+	var rules AWSRules
+	for i, pr := range p.Spec.AWS.Rules {
+		rule := AWSRule{
+			Name:                pr.Name,
+			Effect:              pr.Effect,
+			NamespacePatterns:   pr.NamespacePatterns,
+			NamespaceSelector:   newLabelSelector(pr.NamespaceSelector),
+			RoleNamePatterns:    pr.RoleNamePatterns,
+			RoleNameRegexps:     pr.RoleNameRegexps,
+			AccountIDs:          pr.AccountIDs,
+			CredentialTypes:     pr.CredentialTypes,
+			PolicyArnPatterns:   pr.PolicyArnPatterns,
+			IAMGroupPatterns:    pr.IAMGroupPatterns,
+			AllowPolicyDocument: pr.AllowPolicyDocument,
+			source:              fmt.Sprintf("CloudCredentialPolicy %s aws.rules[%d]", p.Name, i),
+		}
+		if pr.MaxTTL != nil {
+			rule.MaxTTL = pr.MaxTTL.Duration
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
+
+// policyServiceAccounts maps events for a policy to requests to reconcile
+// the service accounts in the namespaces that its rules match, so that they
+// are written to vault or removed as the rules change. Updates are mapped
+// for both the old and new policy.
+func (o *AWSOperator) policyServiceAccounts(obj handler.MapObject) []reconcile.Request {
+	policy, ok := obj.Object.(*v1alpha1.CloudCredentialPolicy)
+	if !ok {
+		return nil
+	}
+	rules := awsPolicyRules(policy)
+
+	ctx := context.Background()
+	requests, err := o.serviceAccountRequests(ctx, hasAWSAnnotations, awsBinding, func(namespace string) bool {
+		// The service account is reconciled if the labels of
+		// its namespace can't be checked
+		namespaceLabels, err := o.rulesNamespaceLabels(ctx, rules, namespace)
+		if err != nil {
+			return true
+		}
+		for i := range rules {
+			if match, err := rules[i].matchesNamespace(namespace, namespaceLabels); err == nil && match {
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		o.log.Error(err, "error listing service accounts for policy", "policy", policy.Name)
+	}
+
+	return requests
+}
+
+// namespaceServiceAccounts maps events for a namespace to requests to
+// reconcile the service accounts in it, so that rules that select the
+// namespace by its labels are evaluated again. There aren't any requests
+// unless one of the current rules selects namespaces by their labels.
+func (o *AWSOperator) namespaceServiceAccounts(obj handler.MapObject) []reconcile.Request {
+	if !isNamespace(obj.Object) {
+		return nil
+	}
+
+	// The labels don't matter unless a rule selects namespaces by them
+	ctx := context.Background()
+	rules, err := o.currentRules(ctx)
+	if err != nil {
+		o.log.Error(err, "error listing rules for namespace", "namespace", obj.Meta.GetName())
+		return nil
+	}
+	if !rules.selectsNamespaces() {
+		return nil
+	}
+
+	requests, err := o.serviceAccountRequests(ctx, hasAWSAnnotations, awsBinding, func(namespace string) bool {
+		return namespace == obj.Meta.GetName()
+	})
+	if err != nil {
+		o.log.Error(err, "error listing service accounts for namespace", "namespace", obj.Meta.GetName())
+	}
+
+	return requests
+}
+
+// rulesNamespaceLabels returns the labels of the namespace, if any of the
+// rules select namespaces by their labels
+func (o *AWSOperator) rulesNamespaceLabels(ctx context.Context, rules AWSRules, namespace string) (map[string]string, error) {
+	if !rules.selectsNamespaces() {
+		return nil, nil
+	}
+
+	return o.namespaceLabels(ctx, namespace)
+}
+
 // Start is ran when the manager starts up. We're using it to clear up orphaned
 // serviceaccounts that could have been missed while the operator was down
 func (o *AWSOperator) Start(stop <-chan struct{}) error {
@@ -243,8 +922,9 @@ func (o *AWSOperator) Start(stop <-chan struct{}) error {
 
 // Reconcile ensures that a ServiceAccount is able to login at
 // auth/kubernetes/role/<prefix>_aws_<namespace>_<name> and retrieve AWS credentials at
-// aws/roles/<prefix>_aws_<namespace>_<name> for the role_arn specified in the
-// vault.uw.systems/aws-role annotation
+// aws/roles/<prefix>_aws_<namespace>_<name> for the role_arns specified in the
+// vault.uw.systems/aws-role annotation, with the session settings in the
+// other vault.uw.systems/aws-* annotations
 func (o *AWSOperator) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	ctx := context.Background()
 
@@ -265,43 +945,362 @@ func (o *AWSOperator) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		return ctrl.Result{}, err
 	}
 
-	// If the service account exists but isn't valid for reconciling that means
-	// it could have previously been valid but the annotation has since been
-	// removed or changed to a value that violates the rules described in
-	// the config file. In which case it should be removed from vault.
-	roleArn := serviceAccount.Annotations[awsRoleAnnotation]
-	if !o.admitEvent(req.Namespace, roleArn) {
-		del = true
+	// A binding takes precedence over the annotations on the service
+	// account
+	binding, err := o.credentialBinding(ctx, req.NamespacedName, v1alpha1.ConditionAWSReady, awsBinding)
+	if err != nil {
+		return ctrl.Result{}, err
 	}
 
 	// Delete the vault objects
 	if del {
+		if binding != nil {
+			o.setBindingCondition(ctx, binding, metav1.Condition{
+				Type:    v1alpha1.ConditionAWSReady,
+				Status:  metav1.ConditionFalse,
+				Reason:  bindingReasonServiceAccountNotFound,
+				Message: "The service account doesn't exist, the vault role has been removed",
+			})
+		}
 		return ctrl.Result{}, o.removeFromVault(req.Namespace, req.Name)
 	}
 
-	err = o.writeToVault(req.Namespace, req.Name, map[string]interface{}{
-		"default_sts_ttl": int(o.DefaultTTL.Seconds()),
-		"role_arns":       []string{roleArn},
-		"credential_type": "assumed_role",
+	annotations := serviceAccount.Annotations
+	if binding != nil {
+		o.setBindingOwner(ctx, binding, serviceAccount)
+		annotations = awsBindingAnnotations(binding.Spec.AWS)
+	}
+
+	rules, err := o.currentRules(ctx)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	namespaceLabels, err := o.rulesNamespaceLabels(ctx, rules, req.Namespace)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// If the service account exists but isn't valid for reconciling that means
+	// it could have previously been valid but the annotation has since been
+	// removed or changed to a value that violates the rules described in
+	// the config file and the policies. In which case it should be removed
+	// from vault.
+	settings, err := o.roleSettings(rules, req.Namespace, namespaceLabels, annotations)
+	if err != nil {
+		if err := o.removeFromVault(req.Namespace, req.Name); err != nil {
+			return ctrl.Result{}, err
+		}
+
+		// The owners of the service account are told why it was
+		// denied, or that the roles were removed along with the
+		// annotations
+		if binding != nil || hasAWSAnnotations(annotations) {
+			o.log.Info("Denied service account", "namespace", req.Namespace, "serviceaccount", req.Name, "reason", err.Error())
+			o.report(ctx, serviceAccount, binding, corev1.EventTypeWarning, &awsStatus{
+				LastSyncTime: time.Now().UTC(),
+				Reason:       eventReasonDenied,
+				Message:      err.Error(),
+			}, "Denied by the rules, the vault role has been removed: %v", err)
+		} else if _, ok := serviceAccount.Annotations[awsStatusAnnotation]; ok {
+			o.recordEvent(serviceAccount, corev1.EventTypeNormal, eventReasonRemoved, "Removed the vault role %s", o.name(req.Namespace, req.Name))
+			o.updateStatus(ctx, serviceAccount, nil)
+		}
+
+		return ctrl.Result{}, nil
+	}
+
+	n := o.name(req.Namespace, req.Name)
+	if err := o.writeToVault(req.Namespace, req.Name, o.settingsData(settings)); err != nil {
+		o.report(ctx, serviceAccount, binding, corev1.EventTypeWarning, &awsStatus{
+			VaultRole:    n,
+			LastSyncTime: time.Now().UTC(),
+			Reason:       eventReasonVaultWriteFailed,
+			Message:      err.Error(),
+		}, "Error writing the vault role %s: %v", n, err)
+		return ctrl.Result{}, err
+	}
+
+	// The rules that permitted the service account are reported, unless
+	// there aren't any rules
+	permittedBy := ""
+	if len(settings.permittedBy) > 0 {
+		permittedBy = ", permitted by " + strings.Join(settings.permittedBy, ", ")
+		o.log.Info("Admitted service account", "namespace", req.Namespace, "serviceaccount", req.Name, "rules", settings.permittedBy)
+	}
+	o.report(ctx, serviceAccount, binding, corev1.EventTypeNormal, &awsStatus{
+		VaultRole:    n,
+		LastSyncTime: time.Now().UTC(),
+		Reason:       eventReasonAdmitted,
+	}, "Wrote the vault role %s%s", n, permittedBy)
+
+	return ctrl.Result{}, nil
+}
+
+// report records the outcome of a reconciliation as an event and in the
+// status of the binding or, if there isn't one, the status annotation of the
+// service account. Service accounts are reconciled again whenever the rules
+// change, so nothing is recorded on them if the status annotation already has
+// the same outcome and vault role.
+func (o *AWSOperator) report(ctx context.Context, serviceAccount *corev1.ServiceAccount, binding *v1alpha1.CloudCredentialBinding, eventType string, status *awsStatus, messageFmt string, args ...interface{}) {
+	if binding == nil {
+		if !awsStatusChanged(serviceAccount, status) {
+			return
+		}
+		o.recordEvent(serviceAccount, eventType, status.Reason, messageFmt, args...)
+		o.updateStatus(ctx, serviceAccount, status)
+		return
+	}
+
+	o.recordEvent(binding, eventType, status.Reason, messageFmt, args...)
+	conditionStatus := metav1.ConditionFalse
+	if status.Reason == eventReasonAdmitted {
+		conditionStatus = metav1.ConditionTrue
+	}
+	o.setBindingCondition(ctx, binding, metav1.Condition{
+		Type:    v1alpha1.ConditionAWSReady,
+		Status:  conditionStatus,
+		Reason:  status.Reason,
+		Message: fmt.Sprintf(messageFmt, args...),
 	})
+}
+
+// awsStatusChanged returns true if the outcome or the vault role in the status
+// are different from the status annotation of the service account
+func awsStatusChanged(serviceAccount *corev1.ServiceAccount, status *awsStatus) bool {
+	data, ok := serviceAccount.Annotations[awsStatusAnnotation]
+	if !ok {
+		return true
+	}
+
+	current := &awsStatus{}
+	if err := json.Unmarshal([]byte(data), current); err != nil {
+		return true
+	}
+
+	return current.Reason != status.Reason || current.Message != status.Message || current.VaultRole != status.VaultRole
+}
+
+// awsBinding returns true if the binding configures aws credentials
+func awsBinding(b *v1alpha1.CloudCredentialBinding) bool {
+	return b.Spec.AWS != nil
+}
+
+// awsBindingAnnotations returns the annotations that are equivalent to the aws
+// section of a binding, so that it's validated and written to vault in the
+// same way
+func awsBindingAnnotations(b *v1alpha1.AWSCredentialBinding) map[string]string {
+	annotations := map[string]string{}
+	set := func(key, value string) {
+		if value != "" {
+			annotations[key] = value
+		}
+	}
+
+	set(awsCredentialTypeAnnotation, b.CredentialType)
+	set(awsRoleAnnotation, strings.Join(b.RoleArns, ","))
+	if b.STSTTL != nil {
+		set(awsSTSTTLAnnotation, b.STSTTL.Duration.String())
+	}
+	if b.MaxSTSTTL != nil {
+		set(awsMaxSTSTTLAnnotation, b.MaxSTSTTL.Duration.String())
+	}
+	set(awsPolicyDocumentAnnotation, b.PolicyDocument)
+	set(awsPolicyArnsAnnotation, strings.Join(b.PolicyArns, ","))
+	set(awsIAMGroupsAnnotation, strings.Join(b.IAMGroups, ","))
 
-	return ctrl.Result{}, err
+	return annotations
+}
+
+// updateStatus patches the status annotation on the service account, or
+// removes it if the status is nil. Errors are logged rather than returned,
+// so that they don't cause the vault objects to be written again.
+func (o *AWSOperator) updateStatus(ctx context.Context, serviceAccount *corev1.ServiceAccount, status *awsStatus) {
+	patch := client.MergeFrom(serviceAccount.DeepCopy())
+
+	if status == nil {
+		delete(serviceAccount.Annotations, awsStatusAnnotation)
+	} else {
+		data, err := json.Marshal(status)
+		if err != nil {
+			o.log.Error(err, "error encoding status", "namespace", serviceAccount.Namespace, "serviceaccount", serviceAccount.Name)
+			return
+		}
+		if serviceAccount.Annotations == nil {
+			serviceAccount.Annotations = make(map[string]string)
+		}
+		serviceAccount.Annotations[awsStatusAnnotation] = string(data)
+	}
+
+	if err := o.KubeClient.Patch(ctx, serviceAccount, patch); err != nil {
+		o.log.Error(err, "error updating status annotation", "namespace", serviceAccount.Namespace, "serviceaccount", serviceAccount.Name)
+	}
 }
 
 // admitEvent controls whether an event should be reconciled or not based on the
-// presence of a role arn and whether the role arn is permitted for this
-// namespace by the rules laid out in the config file
-func (o *AWSOperator) admitEvent(namespace, roleArn string) bool {
-	if roleArn != "" {
-		allowed, err := o.rules.allow(namespace, roleArn)
+// presence of role arns in the annotation and whether every one of them, and
+// the session settings, are permitted for this namespace by the rules laid
+// out in the config file and the policies
+func (o *AWSOperator) admitEvent(namespace string, annotations map[string]string) bool {
+	if len(parseAWSList(annotations[awsRoleAnnotation])) == 0 && annotations[awsCredentialTypeAnnotation] == "" {
+		return false
+	}
+
+	ctx := context.Background()
+	rules, err := o.currentRules(ctx)
+	if err != nil {
+		o.log.Error(err, "error getting rules")
+		return false
+	}
+	namespaceLabels, err := o.rulesNamespaceLabels(ctx, rules, namespace)
+	if err != nil {
+		o.log.Error(err, "error getting namespace labels", "namespace", namespace)
+		return false
+	}
+
+	if _, err := o.roleSettings(rules, namespace, namespaceLabels, annotations); err != nil {
+		o.log.Error(err, "error validating annotations against rules for namespace", "namespace", namespace)
+		return false
+	}
+
+	return true
+}
+
+// roleSettings returns the settings described by the annotations, after
+// checking them against the rules. The sts ttls are bounded by the lowest
+// maxTTL of the rules that allow the role arns, or the credential type.
+func (o *AWSOperator) roleSettings(rules AWSRules, namespace string, namespaceLabels map[string]string, annotations map[string]string) (*awsRoleSettings, error) {
+	settings, err := parseAWSRoleSettings(annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []*AWSRule
+	if settings.credentialType == awsCredentialTypeAssumedRole {
+		for _, roleArn := range settings.roleArns {
+			rule, allowed, err := rules.match(namespace, namespaceLabels, roleArn)
+			if err != nil {
+				return nil, err
+			}
+			if !allowed && rule != nil {
+				return nil, fmt.Errorf("role arn is denied by %s: %s", rule.description(), roleArn)
+			}
+			if !allowed {
+				return nil, fmt.Errorf("role arn is not permitted by the rules: %s", roleArn)
+			}
+			matched = append(matched, rule)
+		}
+	} else {
+		rule, allowed, err := rules.matchCredentialType(namespace, namespaceLabels, settings)
 		if err != nil {
-			o.log.Error(err, "error matching role arn against rules for namespace", "role_arn", roleArn, "namespace", namespace)
-		} else if allowed {
-			return true
+			return nil, err
 		}
+		if !allowed && rule != nil {
+			return nil, fmt.Errorf("credential type or policies are denied by %s: %s", rule.description(), settings.credentialType)
+		}
+		if !allowed {
+			return nil, fmt.Errorf("credential type with these policies is not permitted by the rules: %s", settings.credentialType)
+		}
+		matched = append(matched, rule)
 	}
 
-	return false
+	// The lifetime of iam users is set by the lease ttl of the backend,
+	// rather than an sts ttl, so there isn't anything to bound
+	var maxTTL time.Duration
+	permitted := map[*AWSRule]bool{}
+	for _, rule := range matched {
+		if rule != nil && !permitted[rule] {
+			permitted[rule] = true
+			settings.permittedBy = append(settings.permittedBy, rule.description())
+		}
+		if settings.credentialType != awsCredentialTypeIAMUser && rule != nil && rule.MaxTTL > 0 && (maxTTL == 0 || rule.MaxTTL < maxTTL) {
+			maxTTL = rule.MaxTTL
+		}
+	}
+
+	if maxTTL > 0 {
+		if settings.maxSTSTTL > maxTTL {
+			return nil, fmt.Errorf("max sts ttl %s exceeds the max ttl %s permitted by the rules", settings.maxSTSTTL, maxTTL)
+		}
+		if settings.stsTTL > maxTTL {
+			return nil, fmt.Errorf("sts ttl %s exceeds the max ttl %s permitted by the rules", settings.stsTTL, maxTTL)
+		}
+		if settings.maxSTSTTL == 0 {
+			settings.maxSTSTTL = maxTTL
+		}
+	}
+
+	return settings, nil
+}
+
+// settingsData returns the data for the aws secret role with the settings.
+// The default ttl is used when there isn't an sts ttl annotation, as long as
+// it's within the max sts ttl.
+func (o *AWSOperator) settingsData(settings *awsRoleSettings) map[string]interface{} {
+	// The sts ttls only apply to temporary credentials
+	stsTTL := settings.stsTTL
+	if stsTTL == 0 && settings.credentialType != awsCredentialTypeIAMUser {
+		stsTTL = o.DefaultTTL
+		if settings.maxSTSTTL > 0 && stsTTL > settings.maxSTSTTL {
+			stsTTL = settings.maxSTSTTL
+		}
+	}
+
+	// Every field is written, so that removing an annotation resets the
+	// setting in vault
+	return map[string]interface{}{
+		"credential_type": settings.credentialType,
+		"role_arns":       settings.roleArns,
+		"default_sts_ttl": int(stsTTL.Seconds()),
+		"max_sts_ttl":     int(settings.maxSTSTTL.Seconds()),
+		"policy_document": settings.policyDocument,
+		"policy_arns":     settings.policyArns,
+		"iam_groups":      settings.iamGroups,
+	}
+}
+
+// eventFilter returns the predicates that ensure Reconcile only processes
+// relevant events
+func (o *AWSOperator) eventFilter() predicate.Funcs {
+	return predicate.Funcs{
+		// Service accounts with annotations that aren't
+		// permitted are reconciled too, so that the reason
+		// is recorded on them. Service accounts without
+		// annotations are reconciled if they're bound, in case
+		// the binding was created first.
+		// Only the labels of namespaces are relevant, which
+		// are checked on update
+		CreateFunc: func(e event.CreateEvent) bool {
+			return isCredentialResource(e.Object) || (!isNamespace(e.Object) && o.isServiceAccountConfigured(e.Meta))
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return isCredentialResource(e.Object) || (!isNamespace(e.Object) && o.isServiceAccountConfigured(e.Meta))
+		},
+		// Generic events are only sent to reconcile service
+		// accounts again, whatever their annotations
+		GenericFunc: func(e event.GenericEvent) bool {
+			return true
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			// Update events are a special case, because we
+			// want to remove the roles in vault when the
+			// annotations are removed or changed to
+			// invalid values. Updates to the status of
+			// bindings don't change their generation.
+			if isCredentialResource(e.ObjectNew) {
+				return e.MetaOld.GetGeneration() != e.MetaNew.GetGeneration()
+			}
+			if isNamespace(e.ObjectNew) {
+				return !reflect.DeepEqual(e.MetaOld.GetLabels(), e.MetaNew.GetLabels())
+			}
+			return awsAnnotationsChanged(e.MetaOld.GetAnnotations(), e.MetaNew.GetAnnotations())
+		},
+	}
+}
+
+// isServiceAccountConfigured returns true if the service account has aws
+// annotations or is bound by a binding that configures aws
+func (o *AWSOperator) isServiceAccountConfigured(serviceAccount metav1.Object) bool {
+	return hasAWSAnnotations(serviceAccount.GetAnnotations()) || o.isBound(serviceAccount.GetNamespace(), serviceAccount.GetName(), awsBinding)
 }
 
 // SetupWithManager adds the operator as a runnable and a reconciler on the controller-runtime manager. It also
@@ -311,26 +1310,36 @@ func (o *AWSOperator) SetupWithManager(mgr ctrl.Manager) error {
 		return err
 	}
 
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&corev1.ServiceAccount{}).
-		WithEventFilter(predicate.Funcs{
-			CreateFunc: func(e event.CreateEvent) bool {
-				return o.admitEvent(e.Meta.GetNamespace(), e.Meta.GetAnnotations()[awsRoleAnnotation])
-			},
-			DeleteFunc: func(e event.DeleteEvent) bool {
-				return o.admitEvent(e.Meta.GetNamespace(), e.Meta.GetAnnotations()[awsRoleAnnotation])
-			},
-			GenericFunc: func(e event.GenericEvent) bool {
-				return o.admitEvent(e.Meta.GetNamespace(), e.Meta.GetAnnotations()[awsRoleAnnotation])
-			},
-			UpdateFunc: func(e event.UpdateEvent) bool {
-				// Update events are a special case, because we
-				// want to remove the roles in vault when the
-				// annotation is removed or changed to an
-				// invalid value.
-				return e.MetaOld.GetAnnotations()[awsRoleAnnotation] != e.MetaNew.GetAnnotations()[awsRoleAnnotation]
-			},
-		}).
+	b := ctrl.NewControllerManagedBy(mgr).
+		For(&corev1.ServiceAccount{})
+
+	// Bindings are reconciled as the service account they reference
+	if o.CredentialBindings {
+		b = b.Watches(&source.Kind{Type: &v1alpha1.CloudCredentialBinding{}}, bindingServiceAccount)
+	}
+
+	// Service accounts are reconciled again when the config file is
+	// reloaded
+	o.reconcileEvents = make(chan event.GenericEvent)
+	b = b.Watches(&source.Channel{Source: o.reconcileEvents}, &handler.EnqueueRequestForObject{})
+
+	// Service accounts are reconciled again when the labels of their
+	// namespace change, for the rules that select namespaces by labels.
+	// Rules with selectors can be added by reloading the config file or by
+	// a policy, so namespaces are always watched, but they're ignored
+	// while there aren't any.
+	b = b.Watches(&source.Kind{Type: &corev1.Namespace{}}, &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(o.namespaceServiceAccounts),
+	})
+
+	// Policies are reconciled as the service accounts their rules match
+	if o.CredentialPolicies {
+		b = b.Watches(&source.Kind{Type: &v1alpha1.CloudCredentialPolicy{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(o.policyServiceAccounts),
+		})
+	}
+
+	return b.WithEventFilter(o.eventFilter()).
 		Complete(o)
 }
 
@@ -386,12 +1395,7 @@ func (o *AWSOperator) writeToVault(namespace, serviceAccount string, data map[st
 	o.log.Info("Wrote policy", "namespace", namespace, "serviceaccount", serviceAccount, "key", n)
 
 	// Create kubernetes auth backend role
-	if _, err := o.VaultClient.Logical().Write("auth/"+o.KubernetesAuthBackend+"/role/"+n, map[string]interface{}{
-		"bound_service_account_names":      []string{serviceAccount},
-		"bound_service_account_namespaces": []string{namespace},
-		"policies":                         []string{"default", n},
-		"ttl":                              900,
-	}); err != nil {
+	if _, err := o.VaultClient.Logical().Write("auth/"+o.KubernetesAuthBackend+"/role/"+n, o.kubeAuthRoleData(namespace, serviceAccount, n)); err != nil {
 		return err
 	}
 	o.log.Info("Wrote kubernetes auth backend role", "namespace", namespace, "serviceaccount", serviceAccount, "key", n)
@@ -462,7 +1466,8 @@ func (o *AWSOperator) garbageCollect(keys []interface{}) error {
 }
 
 // hasServiceAccount checks if a managed service account exists for the given
-// namespace+name combination, annotated with a correct and valid annotation
+// namespace+name combination, annotated with a correct and valid annotation or
+// bound by a valid binding
 func (o *AWSOperator) hasServiceAccount(namespace, name string) (bool, error) {
 	serviceAccountList := &corev1.ServiceAccountList{}
 	err := o.KubeClient.List(context.Background(), serviceAccountList)
@@ -471,14 +1476,21 @@ func (o *AWSOperator) hasServiceAccount(namespace, name string) (bool, error) {
 	}
 
 	for _, serviceAccount := range serviceAccountList.Items {
-		if serviceAccount.Namespace == namespace &&
-			serviceAccount.Name == name &&
-			o.admitEvent(
-				serviceAccount.Namespace,
-				serviceAccount.Annotations[awsRoleAnnotation],
-			) {
-			return true, nil
+		if serviceAccount.Namespace != namespace || serviceAccount.Name != name {
+			continue
 		}
+
+		// A binding takes precedence over the annotations
+		annotations := serviceAccount.Annotations
+		bindings, err := o.credentialBindings(context.Background(), types.NamespacedName{Namespace: namespace, Name: name}, awsBinding)
+		if err != nil {
+			return false, err
+		}
+		if len(bindings) > 0 {
+			annotations = awsBindingAnnotations(bindings[0].Spec.AWS)
+		}
+
+		return o.admitEvent(namespace, annotations), nil
 	}
 
 	return false, nil
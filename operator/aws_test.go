@@ -1,7 +1,9 @@
 package operator
 
 import (
+	"context"
 	"encoding/json"
+	"strings"
 	"testing"
 	"time"
 
@@ -12,11 +14,13 @@ import (
 	vaultlogical "github.com/hashicorp/vault/sdk/logical"
 	"github.com/hashicorp/vault/vault"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
@@ -89,6 +93,17 @@ func TestAWSOperatorReconcile(t *testing.T) {
 	assert.Equal(t, []interface{}{"arn:aws:iam::111111111111:role/foobar-role"}, awsRole.Data["role_arns"].([]interface{}))
 	assert.Equal(t, json.Number("3600"), awsRole.Data["default_sts_ttl"].(json.Number))
 
+	// Test that the status annotation names the vault role
+	serviceAccount := &corev1.ServiceAccount{}
+	if err := a.KubeClient.Get(context.Background(), types.NamespacedName{Name: "foo", Namespace: "bar"}, serviceAccount); err != nil {
+		t.Fatal(err)
+	}
+	status := &awsStatus{}
+	if assert.NoError(t, json.Unmarshal([]byte(serviceAccount.Annotations[awsStatusAnnotation]), status)) {
+		assert.Equal(t, "Admitted", status.Reason)
+		assert.Equal(t, "vkcc_aws_bar_foo", status.VaultRole)
+	}
+
 	// UPDATE: test that Reconcile updates the role when the annotation
 	// changes
 	a.KubeClient = fake.NewFakeClientWithScheme(scheme, &corev1.ServiceAccount{
@@ -96,7 +111,10 @@ func TestAWSOperatorReconcile(t *testing.T) {
 			Name:      "foo",
 			Namespace: "bar",
 			Annotations: map[string]string{
-				awsRoleAnnotation: "arn:aws:iam::111111111111:role/another/foobar-role",
+				awsRoleAnnotation:       "arn:aws:iam::111111111111:role/another/foobar-role",
+				awsSTSTTLAnnotation:     "30m",
+				awsMaxSTSTTLAnnotation:  "2h",
+				awsPolicyArnsAnnotation: "arn:aws:iam::aws:policy/ReadOnlyAccess",
 			},
 		},
 	})
@@ -114,6 +132,33 @@ func TestAWSOperatorReconcile(t *testing.T) {
 	updatedAWSRole, err := core.Client.Logical().Read("aws/roles/vkcc_aws_bar_foo")
 	assert.NoError(t, err)
 	assert.Equal(t, []interface{}{"arn:aws:iam::111111111111:role/another/foobar-role"}, updatedAWSRole.Data["role_arns"].([]interface{}))
+	assert.Equal(t, json.Number("1800"), updatedAWSRole.Data["default_sts_ttl"].(json.Number))
+	assert.Equal(t, json.Number("7200"), updatedAWSRole.Data["max_sts_ttl"].(json.Number))
+	assert.Equal(t, []interface{}{"arn:aws:iam::aws:policy/ReadOnlyAccess"}, updatedAWSRole.Data["policy_arns"].([]interface{}))
+
+	// LIST: test that Reconcile writes every role in a comma separated list
+	a.KubeClient = fake.NewFakeClientWithScheme(scheme, &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "bar",
+			Annotations: map[string]string{
+				awsRoleAnnotation: "arn:aws:iam::111111111111:role/another/foobar-role, arn:aws:iam::222222222222:role/foobar-role",
+			},
+		},
+	})
+
+	listResult, err := a.Reconcile(ctrl.Request{
+		NamespacedName: types.NamespacedName{
+			Name:      "foo",
+			Namespace: "bar",
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, ctrl.Result{}, listResult)
+
+	listAWSRole, err := core.Client.Logical().Read("aws/roles/vkcc_aws_bar_foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"arn:aws:iam::111111111111:role/another/foobar-role", "arn:aws:iam::222222222222:role/foobar-role"}, listAWSRole.Data["role_arns"].([]interface{}))
 
 	// REMOVE: finally, test that removing the annotation deletes the objects in
 	// vault
@@ -254,11 +299,14 @@ func TestOperatorReconcileBlocked(t *testing.T) {
 
 	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
 
+	recorder := record.NewFakeRecorder(10)
+
 	a, err := NewAWSOperator(&AWSOperatorConfig{
 		Config: &Config{
 			KubeClient:            fakeKubeClient,
 			KubernetesAuthBackend: "kubernetes",
 			Prefix:                "vkcc",
+			Recorder:              recorder,
 			VaultClient:           core.Client,
 			VaultConfig:           vaultapi.DefaultConfig(),
 		},
@@ -302,6 +350,42 @@ func TestOperatorReconcileBlocked(t *testing.T) {
 	// Test that the returned aws role is nil
 	noAWSRole, err := core.Client.Logical().Read("aws/roles/vkcc_bar_foo")
 	assert.Empty(t, noAWSRole)
+
+	// Test that the denial is recorded on the service account
+	if assert.Len(t, recorder.Events, 1) {
+		event := <-recorder.Events
+		assert.True(t, strings.HasPrefix(event, "Warning Denied "), event)
+		assert.Contains(t, event, "arn:aws:iam::111111111111:role/foobar-role")
+	}
+
+	serviceAccount := &corev1.ServiceAccount{}
+	if err := a.KubeClient.Get(context.Background(), types.NamespacedName{Name: "foo", Namespace: "bar"}, serviceAccount); err != nil {
+		t.Fatal(err)
+	}
+	status := &awsStatus{}
+	if assert.NoError(t, json.Unmarshal([]byte(serviceAccount.Annotations[awsStatusAnnotation]), status)) {
+		assert.Equal(t, "Denied", status.Reason)
+		assert.Empty(t, status.VaultRole)
+		assert.False(t, status.LastSyncTime.IsZero())
+	}
+
+	// Test that reconciling again with the same outcome doesn't record
+	// another event or update the status annotation
+	_, err = a.Reconcile(ctrl.Request{
+		NamespacedName: types.NamespacedName{
+			Name:      "foo",
+			Namespace: "bar",
+		},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, recorder.Events, 0)
+
+	unchanged := &corev1.ServiceAccount{}
+	if err := a.KubeClient.Get(context.Background(), types.NamespacedName{Name: "foo", Namespace: "bar"}, unchanged); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, serviceAccount.Annotations[awsStatusAnnotation], unchanged.Annotations[awsStatusAnnotation])
+	assert.Equal(t, serviceAccount.ResourceVersion, unchanged.ResourceVersion)
 }
 
 // TestAWSOperatorStart tests the garbage collection performed by the Start
@@ -445,21 +529,33 @@ func TestAWSOperatorAdmitEvent(t *testing.T) {
 	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
 
 	o := &AWSOperator{
+		AWSOperatorConfig: &AWSOperatorConfig{
+			Config: &Config{},
+		},
 		log: ctrl.Log.WithName("operator").WithName("aws"),
 	}
 
 	// Test that without any rules any valid event is admitted
-	assert.True(t, o.admitEvent("foobar", "arn:aws:iam::111111111111:role/foobar-role"))
+	assert.True(t, o.admitEvent("foobar", map[string]string{awsRoleAnnotation: "arn:aws:iam::111111111111:role/foobar-role"}))
 
 	// Test that an empty role is not admitted
-	assert.False(t, o.admitEvent("foobar", ""))
+	assert.False(t, o.admitEvent("foobar", map[string]string{awsRoleAnnotation: ""}))
 
 	// Test that an invalid role is not admitted
-	assert.False(t, o.admitEvent("foobar", "foobar"))
+	assert.False(t, o.admitEvent("foobar", map[string]string{awsRoleAnnotation: "foobar"}))
 
 	// Test that a malformed arn is not admitted (missing a second : after
 	// iam)
-	assert.False(t, o.admitEvent("foobar", "arn:aws:iam:111111111111:role/foobar-role"))
+	assert.False(t, o.admitEvent("foobar", map[string]string{awsRoleAnnotation: "arn:aws:iam:111111111111:role/foobar-role"}))
+
+	// Test that a list of valid roles is admitted
+	assert.True(t, o.admitEvent("foobar", map[string]string{awsRoleAnnotation: "arn:aws:iam::111111111111:role/foobar-role, arn:aws:iam::222222222222:role/foobar-role"}))
+
+	// Test that a list is not admitted when one of the roles is invalid
+	assert.False(t, o.admitEvent("foobar", map[string]string{awsRoleAnnotation: "arn:aws:iam::111111111111:role/foobar-role,foobar"}))
+
+	// Test that a list without any roles is not admitted
+	assert.False(t, o.admitEvent("foobar", map[string]string{awsRoleAnnotation: " , "}))
 
 	o.rules = AWSRules{
 		AWSRule{
@@ -499,45 +595,50 @@ func TestAWSOperatorAdmitEvent(t *testing.T) {
 	}
 
 	// Test bar-* : foobar-* is allowed
-	assert.True(t, o.admitEvent("bar-foo", "arn:aws:iam::111111111111:role/foobar-role"))
+	assert.True(t, o.admitEvent("bar-foo", map[string]string{awsRoleAnnotation: "arn:aws:iam::111111111111:role/foobar-role"}))
 
 	// Test that foo : barfoo/* is allowed
-	assert.True(t, o.admitEvent("foo", "arn:aws:iam::111111111111:role/barfoo/role"))
+	assert.True(t, o.admitEvent("foo", map[string]string{awsRoleAnnotation: "arn:aws:iam::111111111111:role/barfoo/role"}))
 
 	// Test that another account ID from the list is matched
-	assert.True(t, o.admitEvent("foo", "arn:aws:iam::000000000000:role/barfoo/role"))
+	assert.True(t, o.admitEvent("foo", map[string]string{awsRoleAnnotation: "arn:aws:iam::000000000000:role/barfoo/role"}))
 
 	// Test the second rule is evaluated
-	assert.True(t, o.admitEvent("kube-system", "arn:aws:iam::000000000000:role/organisation"))
+	assert.True(t, o.admitEvent("kube-system", map[string]string{awsRoleAnnotation: "arn:aws:iam::000000000000:role/organisation"}))
 
 	// Test the second rule is evaluated
-	assert.True(t, o.admitEvent("kube-system", "arn:aws:iam::000000000000:role/org-admins/test-subdivision/foobar"))
+	assert.True(t, o.admitEvent("kube-system", map[string]string{awsRoleAnnotation: "arn:aws:iam::000000000000:role/org-admins/test-subdivision/foobar"}))
 
 	// Test the ? match
-	assert.True(t, o.admitEvent("kube-system", "arn:aws:iam::000000000000:role/system"))
+	assert.True(t, o.admitEvent("kube-system", map[string]string{awsRoleAnnotation: "arn:aws:iam::000000000000:role/system"}))
 
 	// Test that foo : barfoo is not allowed
-	assert.False(t, o.admitEvent("foo", "arn:aws:iam::111111111111:role/barfoo"))
+	assert.False(t, o.admitEvent("foo", map[string]string{awsRoleAnnotation: "arn:aws:iam::111111111111:role/barfoo"}))
 
 	// Test that the matching doesn't match the namespace foo to foobar as a
 	// substring
-	assert.False(t, o.admitEvent("foobar", "arn:aws:iam::111111111111:role/foobar-role"))
+	assert.False(t, o.admitEvent("foobar", map[string]string{awsRoleAnnotation: "arn:aws:iam::111111111111:role/foobar-role"}))
 
 	// Test that an account ID outside of the list is not allowed
-	assert.False(t, o.admitEvent("foo", "arn:aws:iam::222222222222:role/barfoo/role"))
+	assert.False(t, o.admitEvent("foo", map[string]string{awsRoleAnnotation: "arn:aws:iam::222222222222:role/barfoo/role"}))
 
 	// Test that the rules don't mix
-	assert.False(t, o.admitEvent("foo", "arn:aws:iam::000000000000:role/organisation"))
+	assert.False(t, o.admitEvent("foo", map[string]string{awsRoleAnnotation: "arn:aws:iam::000000000000:role/organisation"}))
 
 	// Test that a rule without a namespace pattern does not admit
-	assert.False(t, o.admitEvent("foo", "arn:aws:iam::000000000000:role/fuubar-role"))
+	assert.False(t, o.admitEvent("foo", map[string]string{awsRoleAnnotation: "arn:aws:iam::000000000000:role/fuubar-role"}))
 
 	// Test that a rule without a role pattern does not admit
-	assert.False(t, o.admitEvent("fuubar", "arn:aws:iam::000000000000:role/fuubar-role"))
+	assert.False(t, o.admitEvent("fuubar", map[string]string{awsRoleAnnotation: "arn:aws:iam::000000000000:role/fuubar-role"}))
+
+	// Test that a list is only admitted when every role is allowed
+	assert.True(t, o.admitEvent("foo", map[string]string{awsRoleAnnotation: "arn:aws:iam::111111111111:role/barfoo/role,arn:aws:iam::000000000000:role/barfoo/role"}))
+	assert.False(t, o.admitEvent("foo", map[string]string{awsRoleAnnotation: "arn:aws:iam::111111111111:role/barfoo/role,arn:aws:iam::222222222222:role/barfoo/role"}))
 }
 
 // fakeVaultCluster creates a mock vault cluster with the kubernetes credential
-// backend and the aws secret backend loaded and mounted
+// backend, the aws secret backend and a stand-in for the gcp secret backend
+// loaded and mounted
 func newFakeVaultCluster(t *testing.T) *vault.TestCluster {
 	coreConfig := &vault.CoreConfig{
 		CredentialBackends: map[string]vaultlogical.Factory{
@@ -572,5 +673,576 @@ func newFakeVaultCluster(t *testing.T) *vault.TestCluster {
 	}); err != nil {
 		t.Fatal(err)
 	}
+
+	// The gcp secrets backend validates rolesets against the GCP API, so a
+	// kv backend stands in for it at the same path
+	if err := core.Client.Sys().Mount("gcp", &vaultapi.MountInput{
+		Type: "kv",
+	}); err != nil {
+		t.Fatal(err)
+	}
 	return cluster
 }
+
+func TestAWSOperatorAdmitEventSettings(t *testing.T) {
+	o := &AWSOperator{
+		AWSOperatorConfig: &AWSOperatorConfig{
+			Config: &Config{},
+		},
+		log: ctrl.Log.WithName("operator").WithName("aws"),
+		rules: AWSRules{
+			AWSRule{
+				NamespacePatterns: []string{"foo"},
+				RoleNamePatterns:  []string{"foo-*"},
+				AccountIDs:        []string{"111111111111"},
+				MaxTTL:            time.Hour,
+			},
+		},
+	}
+
+	roleArn := "arn:aws:iam::111111111111:role/foo-role"
+
+	// Valid settings
+	assert.True(t, o.admitEvent("foo", map[string]string{
+		awsRoleAnnotation:           roleArn,
+		awsSTSTTLAnnotation:         "15m",
+		awsMaxSTSTTLAnnotation:      "30m",
+		awsPolicyDocumentAnnotation: `{"Version": "2012-10-17", "Statement": []}`,
+		awsPolicyArnsAnnotation:     "arn:aws:iam::aws:policy/ReadOnlyAccess",
+		awsIAMGroupsAnnotation:      "foo, bar",
+	}))
+
+	// Invalid ttls
+	assert.False(t, o.admitEvent("foo", map[string]string{
+		awsRoleAnnotation:   roleArn,
+		awsSTSTTLAnnotation: "foobar",
+	}))
+	assert.False(t, o.admitEvent("foo", map[string]string{
+		awsRoleAnnotation:   roleArn,
+		awsSTSTTLAnnotation: "-15m",
+	}))
+	assert.False(t, o.admitEvent("foo", map[string]string{
+		awsRoleAnnotation:      roleArn,
+		awsSTSTTLAnnotation:    "30m",
+		awsMaxSTSTTLAnnotation: "15m",
+	}))
+
+	// TTLs that exceed the max ttl of the rule
+	assert.False(t, o.admitEvent("foo", map[string]string{
+		awsRoleAnnotation:   roleArn,
+		awsSTSTTLAnnotation: "2h",
+	}))
+	assert.False(t, o.admitEvent("foo", map[string]string{
+		awsRoleAnnotation:      roleArn,
+		awsMaxSTSTTLAnnotation: "2h",
+	}))
+
+	// Invalid policy document
+	assert.False(t, o.admitEvent("foo", map[string]string{
+		awsRoleAnnotation:           roleArn,
+		awsPolicyDocumentAnnotation: "{",
+	}))
+
+	// Invalid policy arns
+	assert.False(t, o.admitEvent("foo", map[string]string{
+		awsRoleAnnotation:       roleArn,
+		awsPolicyArnsAnnotation: "ReadOnlyAccess",
+	}))
+}
+
+func TestAWSOperatorRoleData(t *testing.T) {
+	o := &AWSOperator{
+		log: ctrl.Log.WithName("operator").WithName("aws"),
+		rules: AWSRules{
+			AWSRule{
+				NamespacePatterns: []string{"foo"},
+				RoleNamePatterns:  []string{"foo-*"},
+				AccountIDs:        []string{"111111111111"},
+				MaxTTL:            time.Hour,
+			},
+			AWSRule{
+				NamespacePatterns: []string{"foo"},
+				RoleNamePatterns:  []string{"bar-*"},
+				AccountIDs:        []string{"111111111111"},
+				MaxTTL:            30 * time.Minute,
+			},
+			AWSRule{
+				NamespacePatterns: []string{"foo"},
+				RoleNamePatterns:  []string{"baz-*"},
+				AccountIDs:        []string{"111111111111"},
+			},
+		},
+		AWSOperatorConfig: &AWSOperatorConfig{
+			DefaultTTL: 45 * time.Minute,
+		},
+	}
+
+	// The default ttl is used when it's within the max ttl of the rule
+	settings, err := o.roleSettings(o.rules, "foo", nil, map[string]string{
+		awsRoleAnnotation: "arn:aws:iam::111111111111:role/foo-role",
+	})
+	if assert.NoError(t, err) {
+		data := o.settingsData(settings)
+		assert.Equal(t, "assumed_role", data["credential_type"])
+		assert.Equal(t, []string{"arn:aws:iam::111111111111:role/foo-role"}, data["role_arns"])
+		assert.Equal(t, 2700, data["default_sts_ttl"])
+		assert.Equal(t, 3600, data["max_sts_ttl"])
+		assert.Equal(t, "", data["policy_document"])
+		assert.Equal(t, []string{}, data["policy_arns"])
+		assert.Equal(t, []string{}, data["iam_groups"])
+	}
+
+	// The lowest max ttl of the matching rules bounds the ttls
+	settings, err = o.roleSettings(o.rules, "foo", nil, map[string]string{
+		awsRoleAnnotation: "arn:aws:iam::111111111111:role/foo-role,arn:aws:iam::111111111111:role/bar-role",
+	})
+	if assert.NoError(t, err) {
+		data := o.settingsData(settings)
+		assert.Equal(t, 1800, data["default_sts_ttl"])
+		assert.Equal(t, 1800, data["max_sts_ttl"])
+	}
+
+	// Rules without a max ttl don't bound the ttls
+	settings, err = o.roleSettings(o.rules, "foo", nil, map[string]string{
+		awsRoleAnnotation:      "arn:aws:iam::111111111111:role/baz-role",
+		awsSTSTTLAnnotation:    "6h",
+		awsIAMGroupsAnnotation: "foo,bar",
+	})
+	if assert.NoError(t, err) {
+		data := o.settingsData(settings)
+		assert.Equal(t, 21600, data["default_sts_ttl"])
+		assert.Equal(t, 0, data["max_sts_ttl"])
+		assert.Equal(t, []string{"foo", "bar"}, data["iam_groups"])
+	}
+
+	// Role arns that aren't allowed are an error
+	_, err = o.roleSettings(o.rules, "foo", nil, map[string]string{
+		awsRoleAnnotation: "arn:aws:iam::222222222222:role/foo-role",
+	})
+	assert.Error(t, err)
+}
+
+func TestAWSOperatorCredentialTypes(t *testing.T) {
+	o := &AWSOperator{
+		log: ctrl.Log.WithName("operator").WithName("aws"),
+		rules: AWSRules{
+			AWSRule{
+				NamespacePatterns: []string{"foo"},
+				RoleNamePatterns:  []string{"foo-*"},
+			},
+			AWSRule{
+				NamespacePatterns:   []string{"bar"},
+				RoleNamePatterns:    []string{"bar-*"},
+				CredentialTypes:     []string{"federation_token", "iam_user"},
+				PolicyArnPatterns:   []string{"arn:aws:iam::aws:policy/*"},
+				IAMGroupPatterns:    []string{"readers"},
+				AllowPolicyDocument: true,
+				MaxTTL:              time.Hour,
+			},
+		},
+		AWSOperatorConfig: &AWSOperatorConfig{
+			Config:     &Config{},
+			DefaultTTL: 15 * time.Minute,
+		},
+	}
+
+	// Only assumed roles are allowed by a rule without credential types
+	assert.True(t, o.admitEvent("foo", map[string]string{
+		awsRoleAnnotation: "arn:aws:iam::111111111111:role/foo-role",
+	}))
+	assert.False(t, o.admitEvent("foo", map[string]string{
+		awsCredentialTypeAnnotation: "iam_user",
+		awsPolicyArnsAnnotation:     "arn:aws:iam::aws:policy/ReadOnlyAccess",
+	}))
+
+	// A rule with credential types only allows those types
+	assert.False(t, o.admitEvent("bar", map[string]string{
+		awsRoleAnnotation: "arn:aws:iam::111111111111:role/bar-role",
+	}))
+	assert.True(t, o.admitEvent("bar", map[string]string{
+		awsCredentialTypeAnnotation: "iam_user",
+		awsPolicyArnsAnnotation:     "arn:aws:iam::aws:policy/ReadOnlyAccess",
+	}))
+
+	// Unsupported credential types
+	assert.False(t, o.admitEvent("bar", map[string]string{
+		awsCredentialTypeAnnotation: "foobar",
+		awsPolicyArnsAnnotation:     "arn:aws:iam::aws:policy/ReadOnlyAccess",
+	}))
+
+	// Role arns can't be used with the other types
+	assert.False(t, o.admitEvent("bar", map[string]string{
+		awsCredentialTypeAnnotation: "federation_token",
+		awsRoleAnnotation:           "arn:aws:iam::111111111111:role/bar-role",
+		awsPolicyArnsAnnotation:     "arn:aws:iam::aws:policy/ReadOnlyAccess",
+	}))
+
+	// The other types require a policy
+	assert.False(t, o.admitEvent("bar", map[string]string{
+		awsCredentialTypeAnnotation: "federation_token",
+	}))
+
+	// IAM users don't have sts ttls
+	assert.False(t, o.admitEvent("bar", map[string]string{
+		awsCredentialTypeAnnotation: "iam_user",
+		awsSTSTTLAnnotation:         "15m",
+		awsPolicyArnsAnnotation:     "arn:aws:iam::aws:policy/ReadOnlyAccess",
+	}))
+
+	// Federation tokens are bounded by the max ttl of the rule
+	settings, err := o.roleSettings(o.rules, "bar", nil, map[string]string{
+		awsCredentialTypeAnnotation: "federation_token",
+		awsPolicyDocumentAnnotation: `{"Version": "2012-10-17", "Statement": []}`,
+	})
+	if assert.NoError(t, err) {
+		data := o.settingsData(settings)
+		assert.Equal(t, "federation_token", data["credential_type"])
+		assert.Equal(t, []string{}, data["role_arns"])
+		assert.Equal(t, 900, data["default_sts_ttl"])
+		assert.Equal(t, 3600, data["max_sts_ttl"])
+	}
+
+	settings, err = o.roleSettings(o.rules, "bar", nil, map[string]string{
+		awsCredentialTypeAnnotation: "iam_user",
+		awsIAMGroupsAnnotation:      "readers",
+	})
+	if assert.NoError(t, err) {
+		data := o.settingsData(settings)
+		assert.Equal(t, "iam_user", data["credential_type"])
+		assert.Equal(t, 0, data["default_sts_ttl"])
+		assert.Equal(t, 0, data["max_sts_ttl"])
+		assert.Equal(t, []string{"readers"}, data["iam_groups"])
+	}
+}
+
+func TestAWSOperatorCredentialPolicies(t *testing.T) {
+	o := &AWSOperator{
+		log: ctrl.Log.WithName("operator").WithName("aws"),
+		rules: AWSRules{
+			AWSRule{
+				NamespacePatterns: []string{"foo"},
+				CredentialTypes:   []string{"federation_token", "iam_user"},
+				PolicyArnPatterns: []string{"arn:aws:iam::111111111111:policy/foo/**"},
+				IAMGroupPatterns:  []string{"foo-*"},
+			},
+			AWSRule{
+				NamespacePatterns: []string{"bar"},
+				CredentialTypes:   []string{"iam_user"},
+			},
+		},
+		AWSOperatorConfig: &AWSOperatorConfig{
+			Config:     &Config{},
+			DefaultTTL: 15 * time.Minute,
+		},
+	}
+
+	// Policies that the rule lists are allowed
+	assert.True(t, o.admitEvent("foo", map[string]string{
+		awsCredentialTypeAnnotation: "iam_user",
+		awsPolicyArnsAnnotation:     "arn:aws:iam::111111111111:policy/foo/bar/read",
+		awsIAMGroupsAnnotation:      "foo-readers",
+	}))
+
+	// Every policy arn must be listed
+	assert.False(t, o.admitEvent("foo", map[string]string{
+		awsCredentialTypeAnnotation: "federation_token",
+		awsPolicyArnsAnnotation:     "arn:aws:iam::111111111111:policy/foo/read,arn:aws:iam::aws:policy/AdministratorAccess",
+	}))
+
+	// Every iam group must be listed
+	assert.False(t, o.admitEvent("foo", map[string]string{
+		awsCredentialTypeAnnotation: "iam_user",
+		awsIAMGroupsAnnotation:      "foo-readers,admins",
+	}))
+
+	// Policy documents must be allowed by the rule
+	_, err := o.roleSettings(o.rules, "foo", nil, map[string]string{
+		awsCredentialTypeAnnotation: "federation_token",
+		awsPolicyDocumentAnnotation: `{"Version": "2012-10-17", "Statement": []}`,
+	})
+	assert.Error(t, err)
+
+	// A rule without policies doesn't allow any
+	assert.False(t, o.admitEvent("bar", map[string]string{
+		awsCredentialTypeAnnotation: "iam_user",
+		awsPolicyArnsAnnotation:     "arn:aws:iam::aws:policy/ReadOnlyAccess",
+	}))
+
+	// Without an allow rule that lists the type, the other types aren't
+	// allowed, even though any role arn is when there aren't any rules
+	admin := map[string]string{
+		awsCredentialTypeAnnotation: "iam_user",
+		awsPolicyArnsAnnotation:     "arn:aws:iam::aws:policy/AdministratorAccess",
+	}
+	o.rules = AWSRules{}
+	assert.True(t, o.admitEvent("foo", map[string]string{
+		awsRoleAnnotation: "arn:aws:iam::111111111111:role/foo-role",
+	}))
+	assert.False(t, o.admitEvent("foo", admin))
+
+	o.rules = AWSRules{
+		AWSRule{
+			Effect:            awsRuleEffectDeny,
+			NamespacePatterns: []string{"*"},
+			CredentialTypes:   []string{"federation_token"},
+		},
+	}
+	assert.False(t, o.admitEvent("foo", admin))
+}
+
+func TestAWSRulesDeny(t *testing.T) {
+	afc := &awsFileConfig{}
+	if err := yaml.Unmarshal([]byte(`
+aws:
+  rules:
+    - name: teams
+      namespacePatterns:
+        - team-*
+      roleNamePatterns:
+        - team-*
+    - name: no-prod-admin
+      effect: deny
+      namespacePatterns:
+        - "*"
+      roleNamePatterns:
+        - "*-admin"
+      accountIDs:
+        - "000000000000"
+`), afc); err != nil {
+		t.Fatal(err)
+	}
+	rules := afc.AWS.Rules
+	assert.NoError(t, rules.validate())
+
+	// Test that the allow rule decides when the deny rule doesn't match
+	rule, allowed, err := rules.match("team-a", nil, "arn:aws:iam::000000000000:role/team-a")
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+	assert.Equal(t, "teams", rule.description())
+
+	// Test that the deny rule takes precedence, even though it's after the
+	// allow rule
+	rule, allowed, err = rules.match("team-a", nil, "arn:aws:iam::000000000000:role/team-a-admin")
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, "no-prod-admin", rule.description())
+
+	// Test that the deny rule only applies to its account
+	_, allowed, err = rules.match("team-a", nil, "arn:aws:iam::111111111111:role/team-a-admin")
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+
+	// Test that nothing matching isn't allowed when there are allow rules
+	rule, allowed, err = rules.match("other", nil, "arn:aws:iam::111111111111:role/other")
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+	assert.Nil(t, rule)
+
+	// Test that nothing is allowed when there are only deny rules
+	denyRules := AWSRules{rules[1]}
+	rule, allowed, err = denyRules.match("other", nil, "arn:aws:iam::111111111111:role/other")
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+	assert.Nil(t, rule)
+	_, allowed, err = denyRules.match("other", nil, "arn:aws:iam::000000000000:role/other-admin")
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+
+	// Test that deny rules apply to the credential types they list, taking
+	// precedence over the rule that allows them
+	allowCredentialTypes := AWSRule{
+		NamespacePatterns:   []string{"*"},
+		CredentialTypes:     []string{awsCredentialTypeFederationToken, awsCredentialTypeIAMUser},
+		PolicyArnPatterns:   []string{"arn:aws:iam::aws:policy/*"},
+		IAMGroupPatterns:    []string{"*"},
+		AllowPolicyDocument: true,
+	}
+	rules = AWSRules{
+		allowCredentialTypes,
+		AWSRule{
+			Effect:            awsRuleEffectDeny,
+			NamespacePatterns: []string{"*"},
+			CredentialTypes:   []string{awsCredentialTypeIAMUser},
+		},
+	}
+	_, allowed, err = rules.matchCredentialType("team-a", nil, &awsRoleSettings{
+		credentialType: awsCredentialTypeIAMUser,
+		iamGroups:      []string{"readers"},
+	})
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+	_, allowed, err = rules.matchCredentialType("team-a", nil, &awsRoleSettings{
+		credentialType: awsCredentialTypeFederationToken,
+		iamGroups:      []string{"readers"},
+	})
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+
+	// Test that deny rules with policies only deny the policies they list
+	rules = AWSRules{
+		allowCredentialTypes,
+		AWSRule{
+			Effect:              awsRuleEffectDeny,
+			NamespacePatterns:   []string{"*"},
+			CredentialTypes:     []string{awsCredentialTypeIAMUser},
+			PolicyArnPatterns:   []string{"arn:aws:iam::aws:policy/AdministratorAccess"},
+			IAMGroupPatterns:    []string{"admins"},
+			AllowPolicyDocument: true,
+		},
+	}
+	_, allowed, err = rules.matchCredentialType("team-a", nil, &awsRoleSettings{
+		credentialType: awsCredentialTypeIAMUser,
+		policyArns:     []string{"arn:aws:iam::aws:policy/ReadOnlyAccess"},
+		iamGroups:      []string{"readers"},
+	})
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+	_, allowed, err = rules.matchCredentialType("team-a", nil, &awsRoleSettings{
+		credentialType: awsCredentialTypeIAMUser,
+		policyArns:     []string{"arn:aws:iam::aws:policy/ReadOnlyAccess", "arn:aws:iam::aws:policy/AdministratorAccess"},
+	})
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+	_, allowed, err = rules.matchCredentialType("team-a", nil, &awsRoleSettings{
+		credentialType: awsCredentialTypeIAMUser,
+		iamGroups:      []string{"readers", "admins"},
+	})
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+	_, allowed, err = rules.matchCredentialType("team-a", nil, &awsRoleSettings{
+		credentialType: awsCredentialTypeIAMUser,
+		policyDocument: `{"Version": "2012-10-17", "Statement": []}`,
+	})
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+
+	// Test that unknown effects are rejected
+	assert.Error(t, AWSRules{AWSRule{Effect: "permit"}}.validate())
+	_, _, err = AWSRules{AWSRule{Effect: "permit"}}.match("team-a", nil, "arn:aws:iam::000000000000:role/team-a")
+	assert.Error(t, err)
+}
+
+func TestAWSRuleMatchesRoleName(t *testing.T) {
+	rule := &AWSRule{
+		RoleNamePatterns: []string{
+			"sysadmin-*",
+			"org/**/s3-admin",
+			"teams/**",
+		},
+		RoleNameRegexps: []string{
+			`app-[0-9]+`,
+			`svc/(foo|bar)/.*`,
+		},
+	}
+	assert.NoError(t, rule.validate())
+
+	for roleName, expected := range map[string]bool{
+		"sysadmin-foo":            true,
+		"sysadmin/foo":            false,
+		"org/s3-admin":            true,
+		"org/a/b/s3-admin":        true,
+		"org/a/b/s3-admin-2":      false,
+		"teams":                   true,
+		"teams/a":                 true,
+		"teams/a/b":               true,
+		"teamsx/a":                false,
+		"app-123":                 true,
+		"app-123-admin":           false,
+		"my-app-123":              false,
+		"svc/foo/role":            true,
+		"svc/baz/role":            false,
+		"not-sysadmin-foo":        false,
+		"org/a/b/s3-admin/nested": false,
+	} {
+		match, err := rule.matchesRoleName(roleName)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, match, roleName)
+	}
+
+	// Test that invalid patterns and regexps are rejected
+	assert.Error(t, (&AWSRule{RoleNamePatterns: []string{"org/**/["}}).validate())
+	assert.Error(t, (&AWSRule{RoleNameRegexps: []string{"app-("}}).validate())
+}
+
+func TestAWSOperatorReportsRule(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = corev1.AddToScheme(scheme)
+
+	fakeKubeClient := fake.NewFakeClientWithScheme(scheme,
+		&corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "allowed",
+				Namespace: "team-a",
+				Annotations: map[string]string{
+					awsRoleAnnotation: "arn:aws:iam::000000000000:role/team-a",
+				},
+			},
+		},
+		&corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "denied",
+				Namespace: "team-a",
+				Annotations: map[string]string{
+					awsRoleAnnotation: "arn:aws:iam::000000000000:role/team-a-admin",
+				},
+			},
+		},
+	)
+
+	fakeVaultCluster := newFakeVaultCluster(t)
+
+	core := fakeVaultCluster.Cores[0]
+
+	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
+
+	recorder := record.NewFakeRecorder(10)
+	a, err := NewAWSOperator(&AWSOperatorConfig{
+		Config: &Config{
+			KubeClient:            fakeKubeClient,
+			KubernetesAuthBackend: "kubernetes",
+			Prefix:                "vkcc",
+			Recorder:              recorder,
+			VaultClient:           core.Client,
+			VaultConfig:           vaultapi.DefaultConfig(),
+		},
+		AWSPath:    "aws",
+		DefaultTTL: 900 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.rules, err = parseAWSConfig([]byte(`
+aws:
+  rules:
+    - namespacePatterns:
+        - team-*
+      roleNamePatterns:
+        - team-*
+    - name: no-admin
+      effect: deny
+      namespacePatterns:
+        - "*"
+      roleNamePatterns:
+        - "*-admin"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = a.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Name: "allowed", Namespace: "team-a"}})
+	assert.NoError(t, err)
+	if assert.Len(t, recorder.Events, 1) {
+		event := <-recorder.Events
+		assert.True(t, strings.HasPrefix(event, "Normal Admitted "), event)
+		assert.Contains(t, event, "permitted by aws.rules[0]")
+	}
+
+	_, err = a.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Name: "denied", Namespace: "team-a"}})
+	assert.NoError(t, err)
+	if assert.Len(t, recorder.Events, 1) {
+		event := <-recorder.Events
+		assert.True(t, strings.HasPrefix(event, "Warning Denied "), event)
+		assert.Contains(t, event, "denied by no-admin")
+	}
+}
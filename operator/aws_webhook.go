@@ -0,0 +1,138 @@
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// awsWebhookPath is the path that the validating webhook is served at
+const awsWebhookPath = "/validate-aws-serviceaccount"
+
+// awsValidator is a validating admission webhook that rejects service
+// accounts with aws annotations that aren't permitted by the rules, so that
+// they're caught when they're applied rather than when they're reconciled
+type awsValidator struct {
+	o *AWSOperator
+}
+
+// Handle implements admission.Handler
+func (v *awsValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	serviceAccount := &corev1.ServiceAccount{}
+	if err := json.Unmarshal(req.Object.Raw, serviceAccount); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	if !hasAWSAnnotations(serviceAccount.Annotations) {
+		return admission.Allowed("")
+	}
+
+	// Updates that don't change the aws annotations are allowed, even if
+	// the rules have changed since, so that other fields (and the status
+	// annotation) can still be updated
+	if len(req.OldObject.Raw) > 0 {
+		oldServiceAccount := &corev1.ServiceAccount{}
+		if err := json.Unmarshal(req.OldObject.Raw, oldServiceAccount); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		if !awsAnnotationsChanged(oldServiceAccount.Annotations, serviceAccount.Annotations) {
+			return admission.Allowed("")
+		}
+	}
+
+	rules, err := v.o.currentRules(ctx)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	namespaceLabels, err := v.o.rulesNamespaceLabels(ctx, rules, req.Namespace)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	if _, err := v.o.roleSettings(rules, req.Namespace, namespaceLabels, serviceAccount.Annotations); err != nil {
+		return admission.Denied(fmt.Sprintf("aws annotations are not permitted by the rules in %s: %v", v.o.rulesDescription(), err))
+	}
+
+	return admission.Allowed("")
+}
+
+// rulesDescription names the rules that the operator is using
+func (o *AWSOperator) rulesDescription() string {
+	description := o.ConfigFile
+	if description == "" {
+		description = "the operator configuration"
+	}
+	if o.CredentialPolicies {
+		description += " and the CloudCredentialPolicies"
+	}
+
+	return description
+}
+
+// admissionReview has the fields that are common to the v1 and v1beta1
+// versions of AdmissionReview
+type admissionReview struct {
+	metav1.TypeMeta `json:",inline"`
+	Request         *admissionv1beta1.AdmissionRequest  `json:"request,omitempty"`
+	Response        *admissionv1beta1.AdmissionResponse `json:"response,omitempty"`
+}
+
+// admissionReviewHandler serves an admission handler for both the v1 and
+// v1beta1 versions of AdmissionReview. The webhook.Admission of this version
+// of controller-runtime only decodes v1beta1, which the api server doesn't
+// send when v1 is listed first in admissionReviewVersions. The versions have
+// the same fields, so the response is returned in the version of the request.
+type admissionReviewHandler struct {
+	handler admission.Handler
+}
+
+// ServeHTTP implements http.Handler
+func (h *admissionReviewHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	review := &admissionReview{}
+	if err := json.NewDecoder(r.Body).Decode(review); err != nil {
+		http.Error(w, fmt.Sprintf("error decoding AdmissionReview: %v", err), http.StatusBadRequest)
+		return
+	}
+	switch review.APIVersion {
+	case admissionv1.SchemeGroupVersion.String(), admissionv1beta1.SchemeGroupVersion.String():
+	default:
+		http.Error(w, fmt.Sprintf("unsupported AdmissionReview version: %s", review.APIVersion), http.StatusBadRequest)
+		return
+	}
+	if review.Request == nil {
+		http.Error(w, "AdmissionReview doesn't contain a request", http.StatusBadRequest)
+		return
+	}
+
+	req := admission.Request{AdmissionRequest: *review.Request}
+	resp := h.handler.Handle(r.Context(), req)
+	if err := resp.Complete(req); err != nil {
+		http.Error(w, fmt.Sprintf("error completing AdmissionResponse: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	review.Request = nil
+	review.Response = &resp.AdmissionResponse
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(review); err != nil {
+		log.Error(err, "error encoding AdmissionReview")
+	}
+}
+
+// SetupWebhookWithManager registers the validating webhook with the webhook
+// server of the controller-runtime manager
+func (o *AWSOperator) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	mgr.GetWebhookServer().Register(awsWebhookPath, &admissionReviewHandler{
+		handler: &awsValidator{o: o},
+	})
+
+	return nil
+}
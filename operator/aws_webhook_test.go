@@ -0,0 +1,156 @@
+package operator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// newServiceAccountRequest returns an admission request for a service account
+// with the given annotations, and the previous annotations if it's an update
+func newServiceAccountRequest(t *testing.T, namespace string, annotations, oldAnnotations map[string]string) admission.Request {
+	raw := func(annotations map[string]string) []byte {
+		data, err := json.Marshal(&corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "foo",
+				Namespace:   namespace,
+				Annotations: annotations,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	req := admission.Request{
+		AdmissionRequest: admissionv1beta1.AdmissionRequest{
+			Operation: admissionv1beta1.Create,
+			Namespace: namespace,
+			Object:    runtime.RawExtension{Raw: raw(annotations)},
+		},
+	}
+	if oldAnnotations != nil {
+		req.Operation = admissionv1beta1.Update
+		req.OldObject = runtime.RawExtension{Raw: raw(oldAnnotations)}
+	}
+
+	return req
+}
+
+func TestAWSValidatorHandle(t *testing.T) {
+	v := &awsValidator{
+		o: &AWSOperator{
+			AWSOperatorConfig: &AWSOperatorConfig{
+				Config:     &Config{},
+				ConfigFile: "/etc/vkcc/config.yaml",
+			},
+			log: ctrl.Log.WithName("operator").WithName("aws"),
+			rules: AWSRules{
+				AWSRule{
+					NamespacePatterns: []string{"foo"},
+					RoleNamePatterns:  []string{"foo-*"},
+				},
+			},
+		},
+	}
+
+	// Service accounts without the annotations are allowed
+	resp := v.Handle(context.Background(), newServiceAccountRequest(t, "foo", nil, nil))
+	assert.True(t, resp.Allowed)
+
+	// Permitted role arns are allowed
+	resp = v.Handle(context.Background(), newServiceAccountRequest(t, "foo", map[string]string{
+		awsRoleAnnotation: "arn:aws:iam::111111111111:role/foo-role",
+	}, nil))
+	assert.True(t, resp.Allowed)
+
+	// Role arns that aren't permitted are denied, naming the rules
+	resp = v.Handle(context.Background(), newServiceAccountRequest(t, "foo", map[string]string{
+		awsRoleAnnotation: "arn:aws:iam::111111111111:role/bar-role",
+	}, nil))
+	assert.False(t, resp.Allowed)
+	assert.Contains(t, resp.Result.Message, "/etc/vkcc/config.yaml")
+	assert.Contains(t, resp.Result.Message, "arn:aws:iam::111111111111:role/bar-role")
+
+	// Invalid arns are denied
+	resp = v.Handle(context.Background(), newServiceAccountRequest(t, "foo", map[string]string{
+		awsRoleAnnotation: "foobar",
+	}, nil))
+	assert.False(t, resp.Allowed)
+
+	// Updates that change the annotations are validated
+	resp = v.Handle(context.Background(), newServiceAccountRequest(t, "foo", map[string]string{
+		awsRoleAnnotation: "arn:aws:iam::111111111111:role/bar-role",
+	}, map[string]string{
+		awsRoleAnnotation: "arn:aws:iam::111111111111:role/foo-role",
+	}))
+	assert.False(t, resp.Allowed)
+
+	// Updates that don't change the annotations are allowed, even if
+	// they're no longer permitted
+	resp = v.Handle(context.Background(), newServiceAccountRequest(t, "foo", map[string]string{
+		awsRoleAnnotation:   "arn:aws:iam::111111111111:role/bar-role",
+		awsStatusAnnotation: `{"reason":"Denied"}`,
+	}, map[string]string{
+		awsRoleAnnotation: "arn:aws:iam::111111111111:role/bar-role",
+	}))
+	assert.True(t, resp.Allowed)
+}
+
+func TestAdmissionReviewHandler(t *testing.T) {
+	h := &admissionReviewHandler{
+		handler: admission.HandlerFunc(func(ctx context.Context, req admission.Request) admission.Response {
+			return admission.Denied("denied " + req.Namespace)
+		}),
+	}
+
+	review := func(apiVersion string) *httptest.ResponseRecorder {
+		body, err := json.Marshal(map[string]interface{}{
+			"apiVersion": apiVersion,
+			"kind":       "AdmissionReview",
+			"request": map[string]interface{}{
+				"uid":       "1234",
+				"namespace": "foo",
+				"operation": "CREATE",
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, awsWebhookPath, bytes.NewReader(body)))
+		return w
+	}
+
+	// The response is returned in the version of the request, with its uid
+	for _, apiVersion := range []string{"admission.k8s.io/v1", "admission.k8s.io/v1beta1"} {
+		w := review(apiVersion)
+		if !assert.Equal(t, http.StatusOK, w.Code, apiVersion) {
+			continue
+		}
+		resp := &admissionReview{}
+		if assert.NoError(t, json.Unmarshal(w.Body.Bytes(), resp)) && assert.NotNil(t, resp.Response) {
+			assert.Equal(t, apiVersion, resp.APIVersion)
+			assert.Equal(t, "AdmissionReview", resp.Kind)
+			assert.Nil(t, resp.Request)
+			assert.Equal(t, "1234", string(resp.Response.UID))
+			assert.False(t, resp.Response.Allowed)
+			assert.Equal(t, "denied foo", resp.Response.Result.Message)
+		}
+	}
+
+	// Other versions are rejected
+	assert.Equal(t, http.StatusBadRequest, review("admission.k8s.io/v2").Code)
+}
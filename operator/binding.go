@@ -0,0 +1,186 @@
+package operator
+
+import (
+	"context"
+	"sort"
+
+	"github.com/utilitywarehouse/vault-kube-cloud-credentials/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// The reasons for the conditions in the status of a binding, in addition to
+// the reasons for the events recorded by the operators
+const (
+	bindingReasonConflict               = "Conflict"
+	bindingReasonServiceAccountNotFound = "ServiceAccountNotFound"
+)
+
+// credentialBinding returns the binding for the service account that
+// configures the provider, if credential bindings are enabled. If more than
+// one binding configures the provider, the oldest is used and the condition
+// of the others is set to explain why they're ignored.
+func (c *Config) credentialBinding(ctx context.Context, key types.NamespacedName, conditionType string, configures func(*v1alpha1.CloudCredentialBinding) bool) (*v1alpha1.CloudCredentialBinding, error) {
+	bindings, err := c.credentialBindings(ctx, key, configures)
+	if err != nil || len(bindings) == 0 {
+		return nil, err
+	}
+
+	for _, b := range bindings[1:] {
+		c.setBindingCondition(ctx, b, metav1.Condition{
+			Type:    conditionType,
+			Status:  metav1.ConditionFalse,
+			Reason:  bindingReasonConflict,
+			Message: "The service account is already bound by " + bindings[0].Name,
+		})
+	}
+
+	return bindings[0], nil
+}
+
+// credentialBindings returns the bindings for the service account that
+// configure the provider, oldest first. There aren't any if credential
+// bindings aren't enabled.
+func (c *Config) credentialBindings(ctx context.Context, key types.NamespacedName, configures func(*v1alpha1.CloudCredentialBinding) bool) ([]*v1alpha1.CloudCredentialBinding, error) {
+	if !c.CredentialBindings {
+		return nil, nil
+	}
+
+	bindingList := &v1alpha1.CloudCredentialBindingList{}
+	if err := c.KubeClient.List(ctx, bindingList, client.InNamespace(key.Namespace)); err != nil {
+		return nil, err
+	}
+
+	var bindings []*v1alpha1.CloudCredentialBinding
+	for i := range bindingList.Items {
+		b := &bindingList.Items[i]
+		if b.Spec.ServiceAccountName == key.Name && b.DeletionTimestamp == nil && configures(b) {
+			bindings = append(bindings, b)
+		}
+	}
+	sort.Slice(bindings, func(i, j int) bool {
+		if !bindings[i].CreationTimestamp.Equal(&bindings[j].CreationTimestamp) {
+			return bindings[i].CreationTimestamp.Before(&bindings[j].CreationTimestamp)
+		}
+		return bindings[i].Name < bindings[j].Name
+	})
+
+	return bindings, nil
+}
+
+// isBound returns true if a binding that configures the provider references
+// the service account, so that it's reconciled without any annotations.
+// Errors listing the bindings are logged and the service account is treated
+// as bound, so that it's reconciled anyway.
+func (c *Config) isBound(namespace, name string, configures func(*v1alpha1.CloudCredentialBinding) bool) bool {
+	bindings, err := c.credentialBindings(context.Background(), types.NamespacedName{Namespace: namespace, Name: name}, configures)
+	if err != nil {
+		log.Error(err, "error listing bindings", "namespace", namespace, "serviceaccount", name)
+		return true
+	}
+
+	return len(bindings) > 0
+}
+
+// serviceAccountRequests returns requests to reconcile the service accounts
+// in the matching namespaces that are annotated or bound for a provider
+func (c *Config) serviceAccountRequests(ctx context.Context, annotated func(map[string]string) bool, configures func(*v1alpha1.CloudCredentialBinding) bool, matchesNamespace func(string) bool) ([]reconcile.Request, error) {
+	keys := map[types.NamespacedName]bool{}
+
+	serviceAccountList := &corev1.ServiceAccountList{}
+	if err := c.KubeClient.List(ctx, serviceAccountList); err != nil {
+		return nil, err
+	}
+	for _, sa := range serviceAccountList.Items {
+		if annotated(sa.Annotations) && matchesNamespace(sa.Namespace) {
+			keys[types.NamespacedName{Namespace: sa.Namespace, Name: sa.Name}] = true
+		}
+	}
+
+	if c.CredentialBindings {
+		bindingList := &v1alpha1.CloudCredentialBindingList{}
+		if err := c.KubeClient.List(ctx, bindingList); err != nil {
+			return nil, err
+		}
+		for i := range bindingList.Items {
+			b := &bindingList.Items[i]
+			if configures(b) && matchesNamespace(b.Namespace) {
+				keys[types.NamespacedName{Namespace: b.Namespace, Name: b.Spec.ServiceAccountName}] = true
+			}
+		}
+	}
+
+	var requests []reconcile.Request
+	for key := range keys {
+		requests = append(requests, reconcile.Request{NamespacedName: key})
+	}
+
+	return requests, nil
+}
+
+// setBindingCondition updates a condition in the status of the binding.
+// Errors are logged rather than returned, so that they don't cause the vault
+// objects to be written again.
+func (c *Config) setBindingCondition(ctx context.Context, binding *v1alpha1.CloudCredentialBinding, condition metav1.Condition) {
+	condition.ObservedGeneration = binding.Generation
+	meta.SetStatusCondition(&binding.Status.Conditions, condition)
+
+	if err := c.KubeClient.Status().Update(ctx, binding); err != nil {
+		log.Error(err, "error updating binding status", "namespace", binding.Namespace, "binding", binding.Name)
+	}
+}
+
+// setBindingOwner makes the service account an owner of the binding, so that
+// the binding is deleted along with the service account
+func (c *Config) setBindingOwner(ctx context.Context, binding *v1alpha1.CloudCredentialBinding, serviceAccount *corev1.ServiceAccount) {
+	for _, ref := range binding.OwnerReferences {
+		if ref.UID == serviceAccount.UID {
+			return
+		}
+	}
+
+	patch := client.MergeFrom(binding.DeepCopy())
+	binding.OwnerReferences = append(binding.OwnerReferences, metav1.OwnerReference{
+		APIVersion: "v1",
+		Kind:       "ServiceAccount",
+		Name:       serviceAccount.Name,
+		UID:        serviceAccount.UID,
+	})
+	if err := c.KubeClient.Patch(ctx, binding, patch); err != nil {
+		log.Error(err, "error setting binding owner", "namespace", binding.Namespace, "binding", binding.Name)
+	}
+}
+
+// bindingServiceAccount maps events for a binding to a request to reconcile
+// the service account it references
+var bindingServiceAccount = &handler.EnqueueRequestsFromMapFunc{
+	ToRequests: handler.ToRequestsFunc(func(o handler.MapObject) []reconcile.Request {
+		binding, ok := o.Object.(*v1alpha1.CloudCredentialBinding)
+		if !ok {
+			return nil
+		}
+
+		return []reconcile.Request{
+			{
+				NamespacedName: types.NamespacedName{
+					Namespace: binding.Namespace,
+					Name:      binding.Spec.ServiceAccountName,
+				},
+			},
+		}
+	}),
+}
+
+// isCredentialBinding returns true if the object is a binding, rather than a
+// service account
+func isCredentialBinding(object runtime.Object) bool {
+	_, ok := object.(*v1alpha1.CloudCredentialBinding)
+
+	return ok
+}
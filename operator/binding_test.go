@@ -0,0 +1,308 @@
+package operator
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/utilitywarehouse/vault-kube-cloud-credentials/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+// TestAWSOperatorReconcileBinding tests that a binding takes precedence over
+// the annotations and that conflicting bindings are reported
+func TestAWSOperatorReconcileBinding(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = corev1.AddToScheme(scheme)
+	_ = v1alpha1.AddToScheme(scheme)
+
+	created := metav1.NewTime(time.Now().Add(-time.Hour))
+	fakeKubeClient := fake.NewFakeClientWithScheme(scheme,
+		&corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "foo",
+				Namespace: "bar",
+				UID:       "foo-uid",
+				Annotations: map[string]string{
+					awsRoleAnnotation: "arn:aws:iam::111111111111:role/annotation-role",
+				},
+			},
+		},
+		&v1alpha1.CloudCredentialBinding{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              "foo",
+				Namespace:         "bar",
+				CreationTimestamp: created,
+			},
+			Spec: v1alpha1.CloudCredentialBindingSpec{
+				ServiceAccountName: "foo",
+				AWS: &v1alpha1.AWSCredentialBinding{
+					RoleArns: []string{"arn:aws:iam::111111111111:role/binding-role"},
+					STSTTL:   &metav1.Duration{Duration: 30 * time.Minute},
+				},
+			},
+		},
+		&v1alpha1.CloudCredentialBinding{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              "foo-conflict",
+				Namespace:         "bar",
+				CreationTimestamp: metav1.NewTime(created.Add(time.Minute)),
+			},
+			Spec: v1alpha1.CloudCredentialBindingSpec{
+				ServiceAccountName: "foo",
+				AWS: &v1alpha1.AWSCredentialBinding{
+					RoleArns: []string{"arn:aws:iam::111111111111:role/conflict-role"},
+				},
+			},
+		},
+	)
+
+	fakeVaultCluster := newFakeVaultCluster(t)
+
+	core := fakeVaultCluster.Cores[0]
+
+	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
+
+	a, err := NewAWSOperator(&AWSOperatorConfig{
+		Config: &Config{
+			CredentialBindings:    true,
+			KubeClient:            fakeKubeClient,
+			KubernetesAuthBackend: "kubernetes",
+			Prefix:                "vkcc",
+			VaultClient:           core.Client,
+			VaultConfig:           vaultapi.DefaultConfig(),
+		},
+		AWSPath:    "aws",
+		DefaultTTL: 900 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := a.Reconcile(ctrl.Request{
+		NamespacedName: types.NamespacedName{
+			Name:      "foo",
+			Namespace: "bar",
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, ctrl.Result{}, result)
+
+	// Test that the role is written from the oldest binding
+	awsRole, err := core.Client.Logical().Read("aws/roles/vkcc_aws_bar_foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"arn:aws:iam::111111111111:role/binding-role"}, awsRole.Data["role_arns"].([]interface{}))
+
+	// Test the status and owner of the binding
+	binding := &v1alpha1.CloudCredentialBinding{}
+	if err := fakeKubeClient.Get(context.Background(), types.NamespacedName{Name: "foo", Namespace: "bar"}, binding); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, meta.IsStatusConditionTrue(binding.Status.Conditions, v1alpha1.ConditionAWSReady))
+	if assert.Len(t, binding.OwnerReferences, 1) {
+		assert.Equal(t, types.UID("foo-uid"), binding.OwnerReferences[0].UID)
+	}
+
+	// Test that the newer binding is reported as a conflict
+	conflict := &v1alpha1.CloudCredentialBinding{}
+	if err := fakeKubeClient.Get(context.Background(), types.NamespacedName{Name: "foo-conflict", Namespace: "bar"}, conflict); err != nil {
+		t.Fatal(err)
+	}
+	condition := meta.FindStatusCondition(conflict.Status.Conditions, v1alpha1.ConditionAWSReady)
+	if assert.NotNil(t, condition) {
+		assert.Equal(t, metav1.ConditionFalse, condition.Status)
+		assert.Equal(t, "Conflict", condition.Reason)
+	}
+}
+
+// TestAWSOperatorBindingFirst tests that a service account without
+// annotations is reconciled when it's created after the binding that
+// references it
+func TestAWSOperatorBindingFirst(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = corev1.AddToScheme(scheme)
+	_ = v1alpha1.AddToScheme(scheme)
+
+	fakeKubeClient := fake.NewFakeClientWithScheme(scheme,
+		&v1alpha1.CloudCredentialBinding{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "foo",
+				Namespace: "bar",
+			},
+			Spec: v1alpha1.CloudCredentialBindingSpec{
+				ServiceAccountName: "foo",
+				AWS: &v1alpha1.AWSCredentialBinding{
+					RoleArns: []string{"arn:aws:iam::111111111111:role/binding-role"},
+				},
+			},
+		},
+	)
+
+	fakeVaultCluster := newFakeVaultCluster(t)
+
+	core := fakeVaultCluster.Cores[0]
+
+	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
+
+	a, err := NewAWSOperator(&AWSOperatorConfig{
+		Config: &Config{
+			CredentialBindings:    true,
+			KubeClient:            fakeKubeClient,
+			KubernetesAuthBackend: "kubernetes",
+			Prefix:                "vkcc",
+			VaultClient:           core.Client,
+			VaultConfig:           vaultapi.DefaultConfig(),
+		},
+		AWSPath:    "aws",
+		DefaultTTL: 900 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serviceAccount := &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "bar",
+		},
+	}
+
+	// Test that the creation of the bound service account is reconciled,
+	// but not the creation of other service accounts without annotations
+	filter := a.eventFilter()
+	assert.True(t, filter.Create(event.CreateEvent{Meta: serviceAccount, Object: serviceAccount}))
+	other := &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "baz",
+			Namespace: "bar",
+		},
+	}
+	assert.False(t, filter.Create(event.CreateEvent{Meta: other, Object: other}))
+
+	if err := fakeKubeClient.Create(context.Background(), serviceAccount); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := a.Reconcile(ctrl.Request{
+		NamespacedName: types.NamespacedName{
+			Name:      "foo",
+			Namespace: "bar",
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, ctrl.Result{}, result)
+
+	// Test that the role is written from the binding
+	awsRole, err := core.Client.Logical().Read("aws/roles/vkcc_aws_bar_foo")
+	if assert.NoError(t, err) && assert.NotNil(t, awsRole) {
+		assert.Equal(t, []interface{}{"arn:aws:iam::111111111111:role/binding-role"}, awsRole.Data["role_arns"].([]interface{}))
+	}
+
+	// Test that the deletion of the bound service account is reconciled
+	assert.True(t, filter.Delete(event.DeleteEvent{Meta: serviceAccount, Object: serviceAccount}))
+}
+
+// TestGCPOperatorBindingFirst tests that the creation of a service account
+// without annotations is reconciled when a binding references it
+func TestGCPOperatorBindingFirst(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = corev1.AddToScheme(scheme)
+	_ = v1alpha1.AddToScheme(scheme)
+
+	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
+
+	o := &GCPOperator{
+		GCPOperatorConfig: &GCPOperatorConfig{
+			Config: &Config{
+				CredentialBindings: true,
+				KubeClient: fake.NewFakeClientWithScheme(scheme,
+					&v1alpha1.CloudCredentialBinding{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:      "foo",
+							Namespace: "bar",
+						},
+						Spec: v1alpha1.CloudCredentialBindingSpec{
+							ServiceAccountName: "foo",
+							GCP: &v1alpha1.GCPCredentialBinding{
+								Project: "my-project",
+								Bindings: map[string][]string{
+									"//cloudresourcemanager.googleapis.com/projects/my-project": {"roles/viewer"},
+								},
+							},
+						},
+					},
+				),
+			},
+		},
+		log: ctrl.Log.WithName("operator").WithName("gcp"),
+	}
+
+	filter := o.eventFilter()
+	bound := &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "bar",
+		},
+	}
+	assert.True(t, filter.Create(event.CreateEvent{Meta: bound, Object: bound}))
+	other := &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "baz",
+			Namespace: "bar",
+		},
+	}
+	assert.False(t, filter.Create(event.CreateEvent{Meta: other, Object: other}))
+}
+
+func TestAWSBindingAnnotations(t *testing.T) {
+	assert.Equal(t, map[string]string{
+		awsRoleAnnotation:       "arn:aws:iam::111111111111:role/foo,arn:aws:iam::111111111111:role/bar",
+		awsSTSTTLAnnotation:     "30m0s",
+		awsPolicyArnsAnnotation: "arn:aws:iam::aws:policy/ReadOnlyAccess",
+	}, awsBindingAnnotations(&v1alpha1.AWSCredentialBinding{
+		RoleArns:   []string{"arn:aws:iam::111111111111:role/foo", "arn:aws:iam::111111111111:role/bar"},
+		STSTTL:     &metav1.Duration{Duration: 30 * time.Minute},
+		PolicyArns: []string{"arn:aws:iam::aws:policy/ReadOnlyAccess"},
+	}))
+
+	assert.Equal(t, map[string]string{
+		awsCredentialTypeAnnotation: "iam_user",
+		awsIAMGroupsAnnotation:      "readers",
+	}, awsBindingAnnotations(&v1alpha1.AWSCredentialBinding{
+		CredentialType: "iam_user",
+		IAMGroups:      []string{"readers"},
+	}))
+}
+
+func TestGCPBindingAnnotations(t *testing.T) {
+	annotations, err := gcpBindingAnnotations(&v1alpha1.GCPCredentialBinding{
+		Project: "my-project",
+		Bindings: map[string][]string{
+			"//cloudresourcemanager.googleapis.com/projects/my-project": {"roles/viewer"},
+		},
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "my-project", annotations[gcpProjectAnnotation])
+		assert.Equal(t, "", annotations[gcpTokenScopesAnnotation])
+
+		bindings, err := parseGCPBindings(annotations[gcpBindingsAnnotation])
+		assert.NoError(t, err)
+		assert.Equal(t, gcpBindings{
+			"//cloudresourcemanager.googleapis.com/projects/my-project": {"roles/viewer"},
+		}, bindings)
+	}
+}
@@ -0,0 +1,821 @@
+package operator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/go-logr/logr"
+	"github.com/utilitywarehouse/vault-kube-cloud-credentials/api/v1alpha1"
+	"gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+const (
+	gcpProjectAnnotation     = "vault.uw.systems/gcp-project"
+	gcpBindingsAnnotation    = "vault.uw.systems/gcp-bindings"
+	gcpTokenScopesAnnotation = "vault.uw.systems/gcp-token-scopes"
+
+	gcpDefaultTokenScope = "https://www.googleapis.com/auth/cloud-platform"
+)
+
+// gcpAnnotations are the annotations that configure the gcp roleset
+var gcpAnnotations = []string{
+	gcpProjectAnnotation,
+	gcpBindingsAnnotation,
+	gcpTokenScopesAnnotation,
+}
+
+var gcpPolicyTemplate = `
+path "{{ .GCPPath }}/token/{{ .Name }}" {
+  capabilities = ["read"]
+}
+path "{{ .GCPPath }}/roleset/{{ .Name }}" {
+  capabilities = ["read"]
+}
+`
+
+var gcpBindingsTemplate = `{{ range $resource, $roles := . }}
+resource {{ printf "%q" $resource }} {
+  roles = [{{ range $i, $role := $roles }}{{ if $i }}, {{ end }}{{ printf "%q" $role }}{{ end }}]
+}
+{{ end }}`
+
+// gcpFileConfig configures the GCP operator. The operator is only enabled
+// when the gcp section is present in the file.
+type gcpFileConfig struct {
+	GCP *struct {
+		Rules GCPRules `yaml:"rules"`
+	} `yaml:"gcp"`
+}
+
+// GCPRules are a collection of rules.
+type GCPRules []GCPRule
+
+// validate returns an error if any of the patterns in the rules are malformed
+func (gr GCPRules) validate() error {
+	for i, r := range gr {
+		for _, patterns := range [][]string{r.NamespacePatterns, r.ProjectPatterns, r.ServiceAccountEmailPatterns, r.RolePatterns} {
+			if err := validatePatterns(patterns); err != nil {
+				return fmt.Errorf("gcp rule %d: %v", i, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// allow returns true if there is a rule in the list of rules which allows
+// a service account in the given namespace to have a roleset in the given
+// project with the given bindings. Rules are evaluated in order and allow
+// returns true for the first matching rule in the list
+func (gr GCPRules) allow(namespace, project string, bindings gcpBindings) (bool, error) {
+	for _, r := range gr {
+		allowed, err := r.allows(namespace, project, bindings)
+		if err != nil {
+			return false, err
+		}
+		if allowed {
+			return true, nil
+		}
+	}
+
+	return len(gr) == 0, nil
+}
+
+// GCPRule restricts the projects, service accounts and roles that a service
+// account can bind to based on patterns which match its namespace
+type GCPRule struct {
+	NamespacePatterns           []string `yaml:"namespacePatterns"`
+	ProjectPatterns             []string `yaml:"projectPatterns"`
+	ServiceAccountEmailPatterns []string `yaml:"serviceAccountEmailPatterns"`
+	RolePatterns                []string `yaml:"rolePatterns"`
+}
+
+// allows checks whether this rule allows a namespace to have a roleset in the
+// project with the bindings. Every binding must be permitted by the rule.
+func (gr *GCPRule) allows(namespace, project string, bindings gcpBindings) (bool, error) {
+	namespaceAllowed, err := matchesPatterns(gr.NamespacePatterns, namespace)
+	if err != nil || !namespaceAllowed {
+		return false, err
+	}
+
+	projectAllowed, err := matchesPatterns(gr.ProjectPatterns, project)
+	if err != nil || !projectAllowed {
+		return false, err
+	}
+
+	for resource, roles := range bindings {
+		resourceAllowed, err := gr.matchesResource(resource)
+		if err != nil || !resourceAllowed {
+			return false, err
+		}
+
+		for _, role := range roles {
+			roleAllowed, err := matchesPatterns(gr.RolePatterns, role)
+			if err != nil || !roleAllowed {
+				return false, err
+			}
+		}
+	}
+
+	return true, nil
+}
+
+// matchesResource returns true if the rule allows bindings on the given
+// resource. Service account resources are matched by their email, any other
+// resource by the project it belongs to. Resources that don't belong to a
+// project aren't allowed.
+func (gr *GCPRule) matchesResource(resource string) (bool, error) {
+	var project, email string
+
+	parts := strings.Split(resource, "/")
+	for i := 0; i < len(parts)-1; i++ {
+		switch parts[i] {
+		case "projects":
+			project = parts[i+1]
+		case "serviceAccounts":
+			email = parts[i+1]
+		}
+	}
+
+	if email != "" {
+		return matchesPatterns(gr.ServiceAccountEmailPatterns, email)
+	}
+	if project != "" {
+		return matchesPatterns(gr.ProjectPatterns, project)
+	}
+
+	return false, nil
+}
+
+// matchesPatterns returns true if the value matches one of the patterns
+func matchesPatterns(patterns []string, value string) (bool, error) {
+	for _, p := range patterns {
+		match, err := filepath.Match(p, value)
+		if err != nil {
+			return false, err
+		}
+		if match {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// validatePatterns returns an error if any of the patterns are malformed.
+// Match only reports a malformed pattern when it gets that far through it, so
+// each pattern is matched against itself.
+func validatePatterns(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := filepath.Match(p, p); err != nil {
+			return fmt.Errorf("%v: %s", err, p)
+		}
+	}
+
+	return nil
+}
+
+// gcpBindings maps GCP resource names to the IAM roles that the roleset is
+// bound to on that resource
+type gcpBindings map[string][]string
+
+// parseGCPBindings parses the value of the bindings annotation, which is a
+// YAML (or JSON) map of resource names to lists of roles, for instance:
+//
+//	//cloudresourcemanager.googleapis.com/projects/my-project:
+//	  - roles/viewer
+func parseGCPBindings(value string) (gcpBindings, error) {
+	bindings := gcpBindings{}
+	if err := yaml.Unmarshal([]byte(value), &bindings); err != nil {
+		return nil, err
+	}
+	if len(bindings) == 0 {
+		return nil, fmt.Errorf("no bindings specified")
+	}
+	for resource, roles := range bindings {
+		if len(roles) == 0 {
+			return nil, fmt.Errorf("no roles specified for resource: %s", resource)
+		}
+	}
+
+	return bindings, nil
+}
+
+// parseGCPTokenScopes parses the comma separated list of scopes in the token
+// scopes annotation, falling back to the cloud-platform scope when it's empty
+func parseGCPTokenScopes(value string) []string {
+	var scopes []string
+	for _, s := range strings.Split(value, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			scopes = append(scopes, s)
+		}
+	}
+	if len(scopes) == 0 {
+		scopes = []string{gcpDefaultTokenScope}
+	}
+
+	return scopes
+}
+
+// hasGCPAnnotations returns true if any of the gcp annotations are set
+func hasGCPAnnotations(annotations map[string]string) bool {
+	for _, a := range gcpAnnotations {
+		if _, ok := annotations[a]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// gcpBinding returns true if the binding configures gcp credentials
+func gcpBinding(b *v1alpha1.CloudCredentialBinding) bool {
+	return b.Spec.GCP != nil
+}
+
+// gcpBindingAnnotations returns the annotations that are equivalent to the gcp
+// section of a binding, so that it's validated and written to vault in the
+// same way
+func gcpBindingAnnotations(b *v1alpha1.GCPCredentialBinding) (map[string]string, error) {
+	annotations := map[string]string{
+		gcpProjectAnnotation:     b.Project,
+		gcpTokenScopesAnnotation: strings.Join(b.TokenScopes, ","),
+	}
+
+	// JSON is valid YAML
+	if len(b.Bindings) > 0 {
+		bindings, err := json.Marshal(b.Bindings)
+		if err != nil {
+			return nil, err
+		}
+		annotations[gcpBindingsAnnotation] = string(bindings)
+	}
+
+	return annotations, nil
+}
+
+// GCPOperatorConfig provides configuration when creating a new Operator
+type GCPOperatorConfig struct {
+	*Config
+	GCPPath string
+}
+
+// GCPOperator is responsible for creating Kubernetes auth roles and GCP secret
+// rolesets based on ServiceAccount annotations
+type GCPOperator struct {
+	*GCPOperatorConfig
+	enabled bool
+	log     logr.Logger
+	// mu guards the rules, which are replaced when the config file is
+	// reloaded
+	mu    sync.RWMutex
+	rules GCPRules
+	// reconcileEvents are sent to reconcile service accounts again
+	reconcileEvents chan event.GenericEvent
+	tmpl            *template.Template
+	bindingsTmpl    *template.Template
+}
+
+// NewGCPOperator returns a configured GCPOperator
+func NewGCPOperator(config *GCPOperatorConfig) (*GCPOperator, error) {
+	tmpl, err := template.New("policy").Parse(gcpPolicyTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	bindingsTmpl, err := template.New("bindings").Parse(gcpBindingsTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	gr := &GCPOperator{
+		GCPOperatorConfig: config,
+		log:               log.WithName("gcp"),
+		tmpl:              tmpl,
+		bindingsTmpl:      bindingsTmpl,
+	}
+
+	return gr, nil
+}
+
+// LoadConfig loads configuration from the content of the config file. The
+// operator is enabled if the file contains a gcp section.
+func (o *GCPOperator) LoadConfig(data []byte) error {
+	enabled, rules, err := parseGCPConfig(data)
+	if err != nil {
+		return err
+	}
+
+	o.enabled = enabled
+	o.mu.Lock()
+	o.rules = rules
+	o.mu.Unlock()
+
+	return nil
+}
+
+// ReloadConfig replaces the rules with the rules in the content of the config
+// file, if they're valid. If the rules have changed then every service
+// account is reconciled again. The operator can't be enabled or disabled
+// without a restart.
+func (o *GCPOperator) ReloadConfig(data []byte) error {
+	enabled, rules, err := parseGCPConfig(data)
+	if err != nil {
+		return err
+	}
+	if enabled != o.enabled {
+		return fmt.Errorf("the gcp section can't be added or removed without restarting the operator")
+	}
+
+	o.mu.Lock()
+	previous := o.rules
+	o.rules = rules
+	o.mu.Unlock()
+
+	if !logRuleChanges(o.log, previous, rules) {
+		return nil
+	}
+
+	requests, err := o.serviceAccountRequests(context.Background(), hasGCPAnnotations, gcpBinding, func(string) bool {
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	requeue(o.reconcileEvents, requests)
+
+	return nil
+}
+
+// parseGCPConfig returns whether the content of a config file enables the
+// gcp operator and the rules in it, after validating them
+func parseGCPConfig(data []byte) (bool, GCPRules, error) {
+	gfc := &gcpFileConfig{}
+	if err := yaml.Unmarshal(data, gfc); err != nil {
+		return false, nil, err
+	}
+
+	if gfc.GCP == nil {
+		return false, nil, nil
+	}
+
+	if err := gfc.GCP.Rules.validate(); err != nil {
+		return false, nil, err
+	}
+
+	return true, gfc.GCP.Rules, nil
+}
+
+// Enabled returns true if the configuration file enabled the operator
+func (o *GCPOperator) Enabled() bool {
+	return o.enabled
+}
+
+// Start is ran when the manager starts up. We're using it to clear up orphaned
+// serviceaccounts that could have been missed while the operator was down
+func (o *GCPOperator) Start(stop <-chan struct{}) error {
+	o.log.Info("garbage collection started")
+
+	// GCP secret rolesets
+	gcpRoleSetList, err := o.VaultClient.Logical().List(o.GCPPath + "/roleset/")
+	if err != nil {
+		return err
+	}
+	if gcpRoleSetList != nil {
+		if keys, ok := gcpRoleSetList.Data["keys"].([]interface{}); ok {
+			err = o.garbageCollect(keys)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Kubernetes auth roles
+	kubeAuthRoleList, err := o.VaultClient.Logical().List("auth/" + o.KubernetesAuthBackend + "/role/")
+	if err != nil {
+		return err
+	}
+	if kubeAuthRoleList != nil {
+		if keys, ok := kubeAuthRoleList.Data["keys"].([]interface{}); ok {
+			err = o.garbageCollect(keys)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Policies
+	policies, err := o.VaultClient.Logical().List("sys/policy")
+	if err != nil {
+		return err
+	}
+	if policies != nil {
+		if keys, ok := policies.Data["keys"].([]interface{}); ok {
+			err = o.garbageCollect(keys)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	o.log.Info("garbage collection finished")
+
+	return nil
+}
+
+// Reconcile ensures that a ServiceAccount is able to login at
+// auth/kubernetes/role/<prefix>_gcp_<namespace>_<name> and retrieve GCP
+// credentials from the roleset at gcp/roleset/<prefix>_gcp_<namespace>_<name>
+// for the project and bindings specified in the vault.uw.systems/gcp-*
+// annotations
+func (o *GCPOperator) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+
+	// Reload vault configuration from the environment, this is primarily
+	// done to pick up CA cert rotations
+	if err := o.VaultConfig.ReadEnvironment(); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// Check if the service account exists. If it doesn't then it's been
+	// deleted and we can remove it from vault
+	del := false
+	serviceAccount := &corev1.ServiceAccount{}
+	err := o.KubeClient.Get(ctx, req.NamespacedName, serviceAccount)
+	if err != nil && errors.IsNotFound(err) {
+		del = true
+	} else if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// A binding takes precedence over the annotations on the service
+	// account
+	binding, err := o.credentialBinding(ctx, req.NamespacedName, v1alpha1.ConditionGCPReady, gcpBinding)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	annotations := serviceAccount.Annotations
+	if binding != nil {
+		if del {
+			o.setBindingCondition(ctx, binding, metav1.Condition{
+				Type:    v1alpha1.ConditionGCPReady,
+				Status:  metav1.ConditionFalse,
+				Reason:  bindingReasonServiceAccountNotFound,
+				Message: "The service account doesn't exist, the vault roleset has been removed",
+			})
+		} else {
+			o.setBindingOwner(ctx, binding, serviceAccount)
+			annotations, err = gcpBindingAnnotations(binding.Spec.GCP)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+	}
+
+	// If the service account exists but isn't valid for reconciling that means
+	// it could have previously been valid but the annotations have since been
+	// removed or changed to values that violate the rules described in
+	// the config file. In which case it should be removed from vault.
+	if !del && !o.admitEvent(req.Namespace, annotations) {
+		del = true
+		if binding != nil {
+			o.setBindingCondition(ctx, binding, metav1.Condition{
+				Type:    v1alpha1.ConditionGCPReady,
+				Status:  metav1.ConditionFalse,
+				Reason:  eventReasonDenied,
+				Message: "Denied by the rules, the vault roleset has been removed",
+			})
+		}
+	}
+
+	// Delete the vault objects
+	if del {
+		return ctrl.Result{}, o.removeFromVault(req.Namespace, req.Name)
+	}
+
+	project := annotations[gcpProjectAnnotation]
+	bindings, err := parseGCPBindings(annotations[gcpBindingsAnnotation])
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	renderedBindings, err := o.renderGCPBindingsTemplate(bindings)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	err = o.writeToVault(req.Namespace, req.Name, map[string]interface{}{
+		"project":      project,
+		"secret_type":  "access_token",
+		"token_scopes": parseGCPTokenScopes(annotations[gcpTokenScopesAnnotation]),
+		"bindings":     renderedBindings,
+	})
+
+	if binding != nil {
+		condition := metav1.Condition{
+			Type:    v1alpha1.ConditionGCPReady,
+			Status:  metav1.ConditionTrue,
+			Reason:  eventReasonAdmitted,
+			Message: "Wrote the vault roleset " + o.name(req.Namespace, req.Name),
+		}
+		if err != nil {
+			condition.Status = metav1.ConditionFalse
+			condition.Reason = eventReasonVaultWriteFailed
+			condition.Message = fmt.Sprintf("Error writing the vault roleset %s: %v", o.name(req.Namespace, req.Name), err)
+		}
+		o.setBindingCondition(ctx, binding, condition)
+	}
+
+	return ctrl.Result{}, err
+}
+
+// admitEvent controls whether an event should be reconciled or not based on the
+// presence of a project and valid bindings and whether they are permitted for
+// this namespace by the rules laid out in the config file
+func (o *GCPOperator) admitEvent(namespace string, annotations map[string]string) bool {
+	project := annotations[gcpProjectAnnotation]
+	if project == "" || annotations[gcpBindingsAnnotation] == "" {
+		return false
+	}
+
+	bindings, err := parseGCPBindings(annotations[gcpBindingsAnnotation])
+	if err != nil {
+		o.log.Error(err, "error parsing bindings", "namespace", namespace)
+		return false
+	}
+
+	o.mu.RLock()
+	rules := o.rules
+	o.mu.RUnlock()
+
+	allowed, err := rules.allow(namespace, project, bindings)
+	if err != nil {
+		o.log.Error(err, "error matching project and bindings against rules for namespace", "project", project, "namespace", namespace)
+		return false
+	}
+
+	return allowed
+}
+
+// eventFilter returns the predicates that ensure Reconcile only processes
+// relevant events
+func (o *GCPOperator) eventFilter() predicate.Funcs {
+	return predicate.Funcs{
+		// Service accounts without annotations are reconciled if
+		// they're bound, in case the binding was created first
+		CreateFunc: func(e event.CreateEvent) bool {
+			return isCredentialBinding(e.Object) || o.isServiceAccountConfigured(e.Meta)
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return isCredentialBinding(e.Object) || o.isServiceAccountConfigured(e.Meta)
+		},
+		// Generic events are only sent to reconcile service
+		// accounts again, whatever their annotations
+		GenericFunc: func(e event.GenericEvent) bool {
+			return true
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			// Update events are a special case, because we
+			// want to remove the rolesets in vault when the
+			// annotations are removed or changed to
+			// invalid values. Updates to the status of
+			// bindings don't change their generation.
+			if isCredentialBinding(e.ObjectNew) {
+				return e.MetaOld.GetGeneration() != e.MetaNew.GetGeneration()
+			}
+			oldAnnotations := e.MetaOld.GetAnnotations()
+			newAnnotations := e.MetaNew.GetAnnotations()
+			for _, a := range gcpAnnotations {
+				if oldAnnotations[a] != newAnnotations[a] {
+					return true
+				}
+			}
+			return false
+		},
+	}
+}
+
+// isServiceAccountConfigured returns true if the gcp annotations on the
+// service account are admitted, or if it's bound by a binding that configures
+// gcp
+func (o *GCPOperator) isServiceAccountConfigured(serviceAccount metav1.Object) bool {
+	return o.admitEvent(serviceAccount.GetNamespace(), serviceAccount.GetAnnotations()) || o.isBound(serviceAccount.GetNamespace(), serviceAccount.GetName(), gcpBinding)
+}
+
+// SetupWithManager adds the operator as a runnable and a reconciler on the controller-runtime manager. It also
+// applies event filters that ensure Reconcile only processes relevant ServiceAccount events.
+func (o *GCPOperator) SetupWithManager(mgr ctrl.Manager) error {
+	if err := mgr.Add(o); err != nil {
+		return err
+	}
+
+	b := ctrl.NewControllerManagedBy(mgr).
+		Named("serviceaccount-gcp").
+		For(&corev1.ServiceAccount{})
+
+	// Bindings are reconciled as the service account they reference
+	if o.CredentialBindings {
+		b = b.Watches(&source.Kind{Type: &v1alpha1.CloudCredentialBinding{}}, bindingServiceAccount)
+	}
+
+	// Service accounts are reconciled again when the config file is
+	// reloaded
+	o.reconcileEvents = make(chan event.GenericEvent)
+	b = b.Watches(&source.Channel{Source: o.reconcileEvents}, &handler.EnqueueRequestForObject{})
+
+	return b.WithEventFilter(o.eventFilter()).
+		Complete(o)
+}
+
+// name returns a unique name for the key in vault, derived from the namespace and name of the
+// serviceaccount
+func (o *GCPOperator) name(namespace, serviceAccount string) string {
+	return o.Prefix + "_gcp_" + namespace + "_" + serviceAccount
+}
+
+// parseKey parses a key from vault into its namespace and name. Also returns a
+// bool that indicates whether parsing was successful
+func (o *GCPOperator) parseKey(key string) (string, string, bool) {
+	keyParts := strings.Split(key, "_")
+	if len(keyParts) == 4 && keyParts[0] == o.Prefix && keyParts[1] == "gcp" {
+		return keyParts[2], keyParts[3], true
+	}
+
+	return "", "", false
+}
+
+// renderGCPPolicyTemplate injects the provided name into a policy allowing access
+// to the corresponding GCP secret roleset
+func (o *GCPOperator) renderGCPPolicyTemplate(name string) (string, error) {
+	var policy bytes.Buffer
+	if err := o.tmpl.Execute(&policy, struct {
+		GCPPath string
+		Name    string
+	}{
+		GCPPath: o.GCPPath,
+		Name:    name,
+	}); err != nil {
+		return "", err
+	}
+
+	return policy.String(), nil
+}
+
+// renderGCPBindingsTemplate renders the bindings into the HCL format expected
+// by the GCP secret backend
+func (o *GCPOperator) renderGCPBindingsTemplate(bindings gcpBindings) (string, error) {
+	var rendered bytes.Buffer
+	if err := o.bindingsTmpl.Execute(&rendered, bindings); err != nil {
+		return "", err
+	}
+
+	return rendered.String(), nil
+}
+
+// writeToVault creates the kubernetes auth role and gcp secret roleset required
+// for the given serviceaccount to login and retrieve credentials
+func (o *GCPOperator) writeToVault(namespace, serviceAccount string, data map[string]interface{}) error {
+	n := o.name(namespace, serviceAccount)
+
+	// Create policy for kubernetes auth role
+	policy, err := o.renderGCPPolicyTemplate(n)
+	if err != nil {
+		return err
+	}
+	if _, err := o.VaultClient.Logical().Write("sys/policy/"+n, map[string]interface{}{
+		"policy": policy,
+	}); err != nil {
+		return err
+	}
+	o.log.Info("Wrote policy", "namespace", namespace, "serviceaccount", serviceAccount, "key", n)
+
+	// Create kubernetes auth backend role
+	if _, err := o.VaultClient.Logical().Write("auth/"+o.KubernetesAuthBackend+"/role/"+n, o.kubeAuthRoleData(namespace, serviceAccount, n)); err != nil {
+		return err
+	}
+	o.log.Info("Wrote kubernetes auth backend role", "namespace", namespace, "serviceaccount", serviceAccount, "key", n)
+
+	// The project of an existing roleset can't be updated, so the roleset
+	// must be recreated if it has changed
+	existing, err := o.VaultClient.Logical().Read(o.GCPPath + "/roleset/" + n)
+	if err != nil {
+		return err
+	}
+	if existing != nil && existing.Data["project"] != data["project"] {
+		if _, err := o.VaultClient.Logical().Delete(o.GCPPath + "/roleset/" + n); err != nil {
+			return err
+		}
+		o.log.Info("Deleted gcp secret backend roleset with a different project", "namespace", namespace, "serviceaccount", serviceAccount, "key", n)
+	}
+
+	// Create gcp secret backend roleset
+	if _, err := o.VaultClient.Logical().Write(o.GCPPath+"/roleset/"+n, data); err != nil {
+		return err
+	}
+	o.log.Info("Wrote gcp secret backend roleset", "namespace", namespace, "serviceaccount", serviceAccount, "key", n)
+
+	return nil
+}
+
+// removeFromVault removes the items from vault for the provided serviceaccount
+func (o *GCPOperator) removeFromVault(namespace, serviceAccount string) error {
+	n := o.name(namespace, serviceAccount)
+
+	_, err := o.VaultClient.Logical().Delete(o.GCPPath + "/roleset/" + n)
+	if err != nil {
+		return err
+	}
+	o.log.Info("Deleted GCP backend roleset", "namespace", namespace, "serviceaccount", serviceAccount, "key", n)
+
+	_, err = o.VaultClient.Logical().Delete("auth/" + o.KubernetesAuthBackend + "/role/" + n)
+	if err != nil {
+		return err
+	}
+	o.log.Info("Deleted Kubernetes auth role", "namespace", namespace, "serviceaccount", serviceAccount, "key", n)
+
+	_, err = o.VaultClient.Logical().Delete("sys/policy/" + n)
+	if err != nil {
+		return err
+	}
+	o.log.Info("Deleted policy", "namespace", namespace, "serviceaccount", serviceAccount, "key", n)
+
+	return nil
+}
+
+// garbageCollect iterates through a list of keys from a vault list, finds items
+// managed by the operator and removes them if they don't have a corresponding
+// serviceaccount in Kubernetes
+func (o *GCPOperator) garbageCollect(keys []interface{}) error {
+	for _, k := range keys {
+		key, ok := k.(string)
+		if !ok {
+			continue
+		}
+
+		namespace, name, parsed := o.parseKey(key)
+		if parsed {
+			has, err := o.hasServiceAccount(namespace, name)
+			if err != nil {
+				return err
+			}
+			if !has {
+				// Delete
+				err := o.removeFromVault(namespace, name)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// hasServiceAccount checks if a managed service account exists for the given
+// namespace+name combination, annotated with correct and valid annotations or
+// bound by a valid binding
+func (o *GCPOperator) hasServiceAccount(namespace, name string) (bool, error) {
+	serviceAccountList := &corev1.ServiceAccountList{}
+	err := o.KubeClient.List(context.Background(), serviceAccountList)
+	if err != nil {
+		return false, err
+	}
+
+	for _, serviceAccount := range serviceAccountList.Items {
+		if serviceAccount.Namespace != namespace || serviceAccount.Name != name {
+			continue
+		}
+
+		// A binding takes precedence over the annotations
+		annotations := serviceAccount.Annotations
+		bindings, err := o.credentialBindings(context.Background(), types.NamespacedName{Namespace: namespace, Name: name}, gcpBinding)
+		if err != nil {
+			return false, err
+		}
+		if len(bindings) > 0 {
+			annotations, err = gcpBindingAnnotations(bindings[0].Spec.GCP)
+			if err != nil {
+				return false, err
+			}
+		}
+
+		return o.admitEvent(namespace, annotations), nil
+	}
+
+	return false, nil
+}
@@ -0,0 +1,237 @@
+package operator
+
+import (
+	"testing"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+// TestGCPOperatorReconcile walks through creating and removing objects in
+// vault based on the state of the annotations
+func TestGCPOperatorReconcile(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = corev1.AddToScheme(scheme)
+
+	fakeKubeClient := fake.NewFakeClientWithScheme(scheme, &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "bar",
+			Annotations: map[string]string{
+				gcpProjectAnnotation:  "foobar-project",
+				gcpBindingsAnnotation: "//cloudresourcemanager.googleapis.com/projects/foobar-project: [roles/viewer]",
+			},
+		},
+	})
+
+	fakeVaultCluster := newFakeVaultCluster(t)
+
+	core := fakeVaultCluster.Cores[0]
+
+	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
+
+	g, err := NewGCPOperator(&GCPOperatorConfig{
+		Config: &Config{
+			KubeClient:            fakeKubeClient,
+			KubernetesAuthBackend: "kubernetes",
+			Prefix:                "vkcc",
+			VaultClient:           core.Client,
+			VaultConfig:           vaultapi.DefaultConfig(),
+		},
+		GCPPath: "gcp",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// CREATE: test that Reconcile creates the vault objects for a new SA
+	result, err := g.Reconcile(ctrl.Request{
+		NamespacedName: types.NamespacedName{
+			Name:      "foo",
+			Namespace: "bar",
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, ctrl.Result{}, result)
+
+	// Test that the policy isn't empty
+	policy, err := core.Client.Logical().Read("sys/policy/vkcc_gcp_bar_foo")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, policy.Data["rules"])
+
+	// Test the fields of the kubernetes auth role
+	kubeAuthRole, err := core.Client.Logical().Read("auth/kubernetes/role/vkcc_gcp_bar_foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"foo"}, kubeAuthRole.Data["bound_service_account_names"].([]interface{}))
+	assert.Equal(t, []interface{}{"bar"}, kubeAuthRole.Data["bound_service_account_namespaces"].([]interface{}))
+	assert.Equal(t, []interface{}{"default", "vkcc_gcp_bar_foo"}, kubeAuthRole.Data["policies"].([]interface{}))
+
+	// Test the fields of the gcp roleset
+	gcpRoleSet, err := core.Client.Logical().Read("gcp/roleset/vkcc_gcp_bar_foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "foobar-project", gcpRoleSet.Data["project"])
+	assert.Equal(t, "access_token", gcpRoleSet.Data["secret_type"])
+	assert.Equal(t, []interface{}{gcpDefaultTokenScope}, gcpRoleSet.Data["token_scopes"].([]interface{}))
+	assert.Contains(t, gcpRoleSet.Data["bindings"], `resource "//cloudresourcemanager.googleapis.com/projects/foobar-project" {`)
+	assert.Contains(t, gcpRoleSet.Data["bindings"], `roles = ["roles/viewer"]`)
+
+	// REMOVE: test that removing the annotations deletes the objects in
+	// vault
+	g.KubeClient = fake.NewFakeClientWithScheme(scheme, &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "bar",
+		},
+	})
+	removeResult, err := g.Reconcile(ctrl.Request{
+		NamespacedName: types.NamespacedName{
+			Name:      "foo",
+			Namespace: "bar",
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, ctrl.Result{}, removeResult)
+
+	// Test that the returned policy is nil
+	removedPolicy, err := core.Client.Logical().Read("sys/policy/vkcc_gcp_bar_foo")
+	assert.NoError(t, err)
+	assert.Empty(t, removedPolicy)
+
+	// Test that the returned kubernetes auth role is nil
+	removedKubeAuthRole, err := core.Client.Logical().Read("auth/kubernetes/role/vkcc_gcp_bar_foo")
+	assert.NoError(t, err)
+	assert.Empty(t, removedKubeAuthRole)
+
+	// Test that the returned gcp roleset is nil
+	removedGCPRoleSet, err := core.Client.Logical().Read("gcp/roleset/vkcc_gcp_bar_foo")
+	assert.NoError(t, err)
+	assert.Empty(t, removedGCPRoleSet)
+}
+
+// TestGCPOperatorAdmitEvent tests that events are allowed and disallowed
+// according to the annotations and rules
+func TestGCPOperatorAdmitEvent(t *testing.T) {
+	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
+
+	o := &GCPOperator{
+		log: ctrl.Log.WithName("operator").WithName("gcp"),
+	}
+
+	valid := map[string]string{
+		gcpProjectAnnotation:  "foobar-project",
+		gcpBindingsAnnotation: "//cloudresourcemanager.googleapis.com/projects/foobar-project: [roles/viewer]",
+	}
+
+	// Test that without any rules any valid event is admitted
+	assert.True(t, o.admitEvent("foobar", valid))
+
+	// Test that a missing project is not admitted
+	assert.False(t, o.admitEvent("foobar", map[string]string{
+		gcpBindingsAnnotation: valid[gcpBindingsAnnotation],
+	}))
+
+	// Test that missing bindings are not admitted
+	assert.False(t, o.admitEvent("foobar", map[string]string{
+		gcpProjectAnnotation: valid[gcpProjectAnnotation],
+	}))
+
+	// Test that a resource without roles is not admitted
+	assert.False(t, o.admitEvent("foobar", map[string]string{
+		gcpProjectAnnotation:  valid[gcpProjectAnnotation],
+		gcpBindingsAnnotation: "//cloudresourcemanager.googleapis.com/projects/foobar-project: []",
+	}))
+
+	o.rules = GCPRules{
+		GCPRule{
+			NamespacePatterns: []string{
+				"foo",
+				"bar-*",
+			},
+			ProjectPatterns: []string{
+				"foobar-*",
+			},
+			ServiceAccountEmailPatterns: []string{
+				"*@foobar-project.iam.gserviceaccount.com",
+			},
+			RolePatterns: []string{
+				"roles/viewer",
+				"roles/iam.*",
+			},
+		},
+		GCPRule{
+			NamespacePatterns: []string{
+				"kube-system",
+			},
+			ProjectPatterns: []string{
+				"system",
+			},
+			RolePatterns: []string{
+				"roles/*",
+			},
+		},
+	}
+
+	// Test that a matching namespace, project and role is allowed
+	assert.True(t, o.admitEvent("bar-foo", valid))
+
+	// Test that a namespace which doesn't match is not allowed
+	assert.False(t, o.admitEvent("foobar", valid))
+
+	// Test that a roleset project which doesn't match is not allowed
+	assert.False(t, o.admitEvent("foo", map[string]string{
+		gcpProjectAnnotation:  "system",
+		gcpBindingsAnnotation: valid[gcpBindingsAnnotation],
+	}))
+
+	// Test that a binding on a project which doesn't match is not allowed
+	assert.False(t, o.admitEvent("foo", map[string]string{
+		gcpProjectAnnotation:  "foobar-project",
+		gcpBindingsAnnotation: "//cloudresourcemanager.googleapis.com/projects/system: [roles/viewer]",
+	}))
+
+	// Test that a role which doesn't match is not allowed
+	assert.False(t, o.admitEvent("foo", map[string]string{
+		gcpProjectAnnotation:  "foobar-project",
+		gcpBindingsAnnotation: "//cloudresourcemanager.googleapis.com/projects/foobar-project: [roles/viewer, roles/owner]",
+	}))
+
+	// Test that a binding on a matching service account is allowed
+	assert.True(t, o.admitEvent("foo", map[string]string{
+		gcpProjectAnnotation:  "foobar-project",
+		gcpBindingsAnnotation: "//iam.googleapis.com/projects/foobar-project/serviceAccounts/app@foobar-project.iam.gserviceaccount.com: [roles/iam.serviceAccountTokenCreator]",
+	}))
+
+	// Test that a binding on a service account which doesn't match is not
+	// allowed
+	assert.False(t, o.admitEvent("foo", map[string]string{
+		gcpProjectAnnotation:  "foobar-project",
+		gcpBindingsAnnotation: "//iam.googleapis.com/projects/foobar-project/serviceAccounts/app@system.iam.gserviceaccount.com: [roles/iam.serviceAccountTokenCreator]",
+	}))
+
+	// Test that a resource which doesn't belong to a project is not allowed
+	assert.False(t, o.admitEvent("foo", map[string]string{
+		gcpProjectAnnotation:  "foobar-project",
+		gcpBindingsAnnotation: "//storage.googleapis.com/buckets/foobar: [roles/viewer]",
+	}))
+
+	// Test the second rule is evaluated
+	assert.True(t, o.admitEvent("kube-system", map[string]string{
+		gcpProjectAnnotation:  "system",
+		gcpBindingsAnnotation: "//cloudresourcemanager.googleapis.com/projects/system: [roles/owner]",
+	}))
+
+	// Test that the rules don't mix
+	assert.False(t, o.admitEvent("kube-system", map[string]string{
+		gcpProjectAnnotation:  "system",
+		gcpBindingsAnnotation: "//cloudresourcemanager.googleapis.com/projects/foobar-project: [roles/viewer]",
+	}))
+}
@@ -0,0 +1,95 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// LabelSelector selects namespaces by their labels. It has the same fields as
+// a Kubernetes label selector.
+type LabelSelector struct {
+	MatchLabels      map[string]string          `yaml:"matchLabels"`
+	MatchExpressions []LabelSelectorRequirement `yaml:"matchExpressions"`
+}
+
+// LabelSelectorRequirement is an expression in a LabelSelector. The operator
+// is one of In, NotIn, Exists and DoesNotExist.
+type LabelSelectorRequirement struct {
+	Key      string   `yaml:"key"`
+	Operator string   `yaml:"operator"`
+	Values   []string `yaml:"values"`
+}
+
+// newLabelSelector converts a Kubernetes label selector
+func newLabelSelector(ls *metav1.LabelSelector) *LabelSelector {
+	if ls == nil {
+		return nil
+	}
+
+	selector := &LabelSelector{
+		MatchLabels: ls.MatchLabels,
+	}
+	for _, r := range ls.MatchExpressions {
+		selector.MatchExpressions = append(selector.MatchExpressions, LabelSelectorRequirement{
+			Key:      r.Key,
+			Operator: string(r.Operator),
+			Values:   r.Values,
+		})
+	}
+
+	return selector
+}
+
+// selector returns the selector that matches labels
+func (ls *LabelSelector) selector() (labels.Selector, error) {
+	selector := &metav1.LabelSelector{
+		MatchLabels: ls.MatchLabels,
+	}
+	for _, r := range ls.MatchExpressions {
+		selector.MatchExpressions = append(selector.MatchExpressions, metav1.LabelSelectorRequirement{
+			Key:      r.Key,
+			Operator: metav1.LabelSelectorOperator(r.Operator),
+			Values:   r.Values,
+		})
+	}
+
+	s, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid namespace selector: %v", err)
+	}
+
+	return s, nil
+}
+
+// matches returns true if the selector matches the labels
+func (ls *LabelSelector) matches(namespaceLabels map[string]string) (bool, error) {
+	s, err := ls.selector()
+	if err != nil {
+		return false, err
+	}
+
+	return s.Matches(labels.Set(namespaceLabels)), nil
+}
+
+// namespaceLabels returns the labels of the namespace
+func (c *Config) namespaceLabels(ctx context.Context, name string) (map[string]string, error) {
+	namespace := &corev1.Namespace{}
+	if err := c.KubeClient.Get(ctx, types.NamespacedName{Name: name}, namespace); err != nil {
+		return nil, err
+	}
+
+	return namespace.Labels, nil
+}
+
+// isNamespace returns true if the object is a namespace
+func isNamespace(object runtime.Object) bool {
+	_, ok := object.(*corev1.Namespace)
+
+	return ok
+}
@@ -0,0 +1,171 @@
+package operator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/utilitywarehouse/vault-kube-cloud-credentials/api/v1alpha1"
+	"gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestAWSOperatorNamespaceSelector(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = corev1.AddToScheme(scheme)
+
+	fakeKubeClient := fake.NewFakeClientWithScheme(scheme,
+		&corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   "payments-prod",
+				Labels: map[string]string{"team": "payments", "env": "prod"},
+			},
+		},
+		&corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   "payments-dev",
+				Labels: map[string]string{"team": "payments", "env": "dev"},
+			},
+		},
+		&corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   "other-prod",
+				Labels: map[string]string{"team": "other", "env": "prod"},
+			},
+		},
+	)
+
+	afc := &awsFileConfig{}
+	if err := yaml.Unmarshal([]byte(`
+aws:
+  rules:
+    - namespaceSelector:
+        matchLabels:
+          team: payments
+        matchExpressions:
+          - key: env
+            operator: In
+            values:
+              - prod
+      roleNamePatterns:
+        - payments-*
+    - namespacePatterns:
+        - "*-dev"
+      namespaceSelector:
+        matchLabels:
+          team: payments
+      roleNamePatterns:
+        - dev-*
+`), afc); err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, afc.AWS.Rules.validate())
+
+	o := &AWSOperator{
+		AWSOperatorConfig: &AWSOperatorConfig{
+			Config: &Config{
+				KubeClient: fakeKubeClient,
+			},
+		},
+		log:   log.WithName("aws"),
+		rules: afc.AWS.Rules,
+	}
+
+	// Test that namespaces are selected by their labels
+	assert.True(t, o.admitEvent("payments-prod", map[string]string{awsRoleAnnotation: "arn:aws:iam::111111111111:role/payments-role"}))
+	assert.False(t, o.admitEvent("payments-dev", map[string]string{awsRoleAnnotation: "arn:aws:iam::111111111111:role/payments-role"}))
+	assert.False(t, o.admitEvent("other-prod", map[string]string{awsRoleAnnotation: "arn:aws:iam::111111111111:role/payments-role"}))
+
+	// Test that both the patterns and the selector must match
+	assert.True(t, o.admitEvent("payments-dev", map[string]string{awsRoleAnnotation: "arn:aws:iam::111111111111:role/dev-role"}))
+	assert.False(t, o.admitEvent("payments-prod", map[string]string{awsRoleAnnotation: "arn:aws:iam::111111111111:role/dev-role"}))
+
+	// Test that namespaces that don't exist aren't selected
+	assert.False(t, o.admitEvent("payments-staging", map[string]string{awsRoleAnnotation: "arn:aws:iam::111111111111:role/payments-role"}))
+
+	// Test that invalid selectors are rejected
+	assert.Error(t, AWSRules{
+		AWSRule{
+			NamespaceSelector: &LabelSelector{
+				MatchExpressions: []LabelSelectorRequirement{
+					{Key: "env", Operator: "Equals", Values: []string{"prod"}},
+				},
+			},
+		},
+	}.validate())
+}
+
+func TestAWSOperatorNamespaceServiceAccounts(t *testing.T) {
+	o := newPolicyTestOperator(
+		&corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "annotated",
+				Namespace:   "payments-prod",
+				Annotations: map[string]string{awsRoleAnnotation: "arn:aws:iam::111111111111:role/payments-role"},
+			},
+		},
+		&corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "unannotated",
+				Namespace: "payments-prod",
+			},
+		},
+		&corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "other",
+				Namespace:   "other-prod",
+				Annotations: map[string]string{awsRoleAnnotation: "arn:aws:iam::111111111111:role/payments-role"},
+			},
+		},
+		&v1alpha1.CloudCredentialBinding{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "bound",
+				Namespace: "payments-prod",
+			},
+			Spec: v1alpha1.CloudCredentialBindingSpec{
+				ServiceAccountName: "bound",
+				AWS:                &v1alpha1.AWSCredentialBinding{},
+			},
+		},
+	)
+
+	namespace := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "payments-prod",
+		},
+	}
+
+	// Namespaces are ignored when no rules select them by their labels
+	assert.Empty(t, o.namespaceServiceAccounts(handler.MapObject{Meta: namespace, Object: namespace}))
+
+	o.rules = append(o.rules, AWSRule{
+		NamespaceSelector: &LabelSelector{MatchLabels: map[string]string{"team": "payments"}},
+		RoleNamePatterns:  []string{"payments-*"},
+	})
+	assert.ElementsMatch(t, []reconcile.Request{
+		{NamespacedName: types.NamespacedName{Namespace: "payments-prod", Name: "annotated"}},
+		{NamespacedName: types.NamespacedName{Namespace: "payments-prod", Name: "bound"}},
+	}, o.namespaceServiceAccounts(handler.MapObject{Meta: namespace, Object: namespace}))
+}
+
+func TestNewLabelSelector(t *testing.T) {
+	assert.Nil(t, newLabelSelector(nil))
+	assert.Equal(t, &LabelSelector{
+		MatchLabels: map[string]string{"team": "payments"},
+		MatchExpressions: []LabelSelectorRequirement{
+			{Key: "env", Operator: "NotIn", Values: []string{"dev"}},
+		},
+	}, newLabelSelector(&metav1.LabelSelector{
+		MatchLabels: map[string]string{"team": "payments"},
+		MatchExpressions: []metav1.LabelSelectorRequirement{
+			{Key: "env", Operator: metav1.LabelSelectorOpNotIn, Values: []string{"dev"}},
+		},
+	}))
+}
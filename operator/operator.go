@@ -2,6 +2,8 @@ package operator
 
 import (
 	vault "github.com/hashicorp/vault/api"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
@@ -10,13 +12,59 @@ var (
 	log = ctrl.Log.WithName("operator")
 )
 
+// The reasons for the events recorded by the operators, which are also used
+// for the conditions in the status of bindings
+const (
+	eventReasonAdmitted         = "Admitted"
+	eventReasonDenied           = "Denied"
+	eventReasonVaultWriteFailed = "VaultWriteFailed"
+	eventReasonRemoved          = "Removed"
+)
+
 // Config is the base configuration for an operator
 type Config struct {
-	KubeClient            client.Client
-	KubernetesAuthBackend string
-	Prefix                string
-	VaultClient           *vault.Client
-	VaultConfig           *vault.Config
+	// CredentialBindings enables the CloudCredentialBinding resources,
+	// which take precedence over the annotations. The CRD must be
+	// installed.
+	CredentialBindings bool
+	// CredentialPolicies enables the CloudCredentialPolicy resources,
+	// which add to the rules in the config file. The CRD must be
+	// installed.
+	CredentialPolicies     bool
+	KubeClient             client.Client
+	KubernetesAuthAudience string
+	KubernetesAuthBackend  string
+	Prefix                 string
+	// Recorder records events on the objects that the operator
+	// reconciles. Events aren't recorded if it's nil.
+	Recorder    record.EventRecorder
+	VaultClient *vault.Client
+	VaultConfig *vault.Config
+}
+
+// recordEvent records an event on the given object, if there's a recorder
+func (c *Config) recordEvent(object runtime.Object, eventType, reason, messageFmt string, args ...interface{}) {
+	if c.Recorder == nil {
+		return
+	}
+
+	c.Recorder.Eventf(object, eventType, reason, messageFmt, args...)
+}
+
+// kubeAuthRoleData returns the data for a kubernetes auth role that allows the
+// given serviceaccount to login with the named policy
+func (c *Config) kubeAuthRoleData(namespace, serviceAccount, policy string) map[string]interface{} {
+	data := map[string]interface{}{
+		"bound_service_account_names":      []string{serviceAccount},
+		"bound_service_account_namespaces": []string{namespace},
+		"policies":                         []string{"default", policy},
+		"ttl":                              900,
+	}
+	if c.KubernetesAuthAudience != "" {
+		data["audience"] = c.KubernetesAuthAudience
+	}
+
+	return data
 }
 
 // Operator is responsible for providing access to cloud IAM roles for
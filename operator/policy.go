@@ -0,0 +1,42 @@
+package operator
+
+import (
+	"context"
+	"sort"
+
+	"github.com/utilitywarehouse/vault-kube-cloud-credentials/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// credentialPolicies returns the policies, ordered by name. There aren't any
+// if credential policies aren't enabled.
+func (c *Config) credentialPolicies(ctx context.Context) ([]v1alpha1.CloudCredentialPolicy, error) {
+	if !c.CredentialPolicies {
+		return nil, nil
+	}
+
+	policyList := &v1alpha1.CloudCredentialPolicyList{}
+	if err := c.KubeClient.List(ctx, policyList); err != nil {
+		return nil, err
+	}
+
+	policies := policyList.Items
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].Name < policies[j].Name
+	})
+
+	return policies, nil
+}
+
+// isCredentialPolicy returns true if the object is a policy
+func isCredentialPolicy(object runtime.Object) bool {
+	_, ok := object.(*v1alpha1.CloudCredentialPolicy)
+
+	return ok
+}
+
+// isCredentialResource returns true if the object is a binding or a policy,
+// rather than a service account
+func isCredentialResource(object runtime.Object) bool {
+	return isCredentialBinding(object) || isCredentialPolicy(object)
+}
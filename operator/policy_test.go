@@ -0,0 +1,175 @@
+package operator
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/utilitywarehouse/vault-kube-cloud-credentials/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func newPolicyTestOperator(objs ...runtime.Object) *AWSOperator {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = corev1.AddToScheme(scheme)
+	_ = v1alpha1.AddToScheme(scheme)
+
+	return &AWSOperator{
+		AWSOperatorConfig: &AWSOperatorConfig{
+			Config: &Config{
+				CredentialBindings: true,
+				CredentialPolicies: true,
+				KubeClient:         fake.NewFakeClientWithScheme(scheme, objs...),
+			},
+		},
+		log: log.WithName("aws"),
+		rules: AWSRules{
+			AWSRule{
+				NamespacePatterns: []string{"foo"},
+				RoleNamePatterns:  []string{"foo-*"},
+			},
+		},
+	}
+}
+
+func TestAWSOperatorCurrentRules(t *testing.T) {
+	o := newPolicyTestOperator(
+		&v1alpha1.CloudCredentialPolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "b"},
+			Spec: v1alpha1.CloudCredentialPolicySpec{
+				AWS: &v1alpha1.AWSCredentialPolicy{
+					Rules: []v1alpha1.AWSPolicyRule{
+						{
+							NamespacePatterns: []string{"bar"},
+							RoleNamePatterns:  []string{"bar-*"},
+							AccountIDs:        []string{"111111111111"},
+							MaxTTL:            &metav1.Duration{Duration: time.Hour},
+						},
+					},
+				},
+			},
+		},
+		&v1alpha1.CloudCredentialPolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "a"},
+			Spec: v1alpha1.CloudCredentialPolicySpec{
+				AWS: &v1alpha1.AWSCredentialPolicy{
+					Rules: []v1alpha1.AWSPolicyRule{
+						{
+							NamespacePatterns: []string{"baz"},
+							CredentialTypes:   []string{"iam_user"},
+							IAMGroupPatterns:  []string{"readers"},
+						},
+					},
+				},
+			},
+		},
+		// Policies without aws rules are ignored
+		&v1alpha1.CloudCredentialPolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "c"},
+		},
+	)
+
+	rules, err := o.currentRules(context.Background())
+	if assert.NoError(t, err) {
+		assert.Equal(t, AWSRules{
+			o.rules[0],
+			AWSRule{
+				NamespacePatterns: []string{"baz"},
+				CredentialTypes:   []string{"iam_user"},
+				IAMGroupPatterns:  []string{"readers"},
+				source:            "CloudCredentialPolicy a aws.rules[0]",
+			},
+			AWSRule{
+				NamespacePatterns: []string{"bar"},
+				RoleNamePatterns:  []string{"bar-*"},
+				AccountIDs:        []string{"111111111111"},
+				MaxTTL:            time.Hour,
+				source:            "CloudCredentialPolicy b aws.rules[0]",
+			},
+		}, rules)
+	}
+
+	// The rules from the config file and the policies are both applied
+	assert.True(t, o.admitEvent("foo", map[string]string{awsRoleAnnotation: "arn:aws:iam::111111111111:role/foo-role"}))
+	assert.True(t, o.admitEvent("bar", map[string]string{awsRoleAnnotation: "arn:aws:iam::111111111111:role/bar-role"}))
+	assert.True(t, o.admitEvent("baz", map[string]string{
+		awsCredentialTypeAnnotation: "iam_user",
+		awsIAMGroupsAnnotation:      "readers",
+	}))
+	assert.False(t, o.admitEvent("bar", map[string]string{awsRoleAnnotation: "arn:aws:iam::222222222222:role/bar-role"}))
+	assert.False(t, o.admitEvent("bar", map[string]string{
+		awsRoleAnnotation:   "arn:aws:iam::111111111111:role/bar-role",
+		awsSTSTTLAnnotation: "2h",
+	}))
+
+	// Policies are ignored when they aren't enabled
+	o.CredentialPolicies = false
+	assert.False(t, o.admitEvent("bar", map[string]string{awsRoleAnnotation: "arn:aws:iam::111111111111:role/bar-role"}))
+}
+
+func TestAWSOperatorPolicyServiceAccounts(t *testing.T) {
+	o := newPolicyTestOperator(
+		&corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "annotated",
+				Namespace:   "team-a",
+				Annotations: map[string]string{awsRoleAnnotation: "arn:aws:iam::111111111111:role/foo-role"},
+			},
+		},
+		&corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "unannotated",
+				Namespace: "team-a",
+			},
+		},
+		&corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "other",
+				Namespace:   "other",
+				Annotations: map[string]string{awsRoleAnnotation: "arn:aws:iam::111111111111:role/foo-role"},
+			},
+		},
+		&v1alpha1.CloudCredentialBinding{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "bound",
+				Namespace: "team-b",
+			},
+			Spec: v1alpha1.CloudCredentialBindingSpec{
+				ServiceAccountName: "bound",
+				AWS:                &v1alpha1.AWSCredentialBinding{},
+			},
+		},
+	)
+
+	requests := o.policyServiceAccounts(handler.MapObject{
+		Object: &v1alpha1.CloudCredentialPolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "teams"},
+			Spec: v1alpha1.CloudCredentialPolicySpec{
+				AWS: &v1alpha1.AWSCredentialPolicy{
+					Rules: []v1alpha1.AWSPolicyRule{
+						{
+							NamespacePatterns: []string{"team-*"},
+							RoleNamePatterns:  []string{"*"},
+						},
+					},
+				},
+			},
+		},
+	})
+	assert.ElementsMatch(t, []reconcile.Request{
+		{NamespacedName: types.NamespacedName{Namespace: "team-a", Name: "annotated"}},
+		{NamespacedName: types.NamespacedName{Namespace: "team-b", Name: "bound"}},
+	}, requests)
+
+	// Other objects aren't mapped
+	assert.Empty(t, o.policyServiceAccounts(handler.MapObject{Object: &corev1.ServiceAccount{}}))
+}
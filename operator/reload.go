@@ -0,0 +1,146 @@
+package operator
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// ConfigReloader is an operator that can replace its rules with the rules in
+// a new version of the config file
+type ConfigReloader interface {
+	// ReloadConfig replaces the rules with the rules in the content of
+	// the config file, if they're valid
+	ReloadConfig(data []byte) error
+}
+
+// ConfigWatcher reloads the config file of the operators when its content
+// changes. The file is polled, rather than watched for events, so that the
+// symlinks that are swapped when a mounted ConfigMap is updated are followed.
+type ConfigWatcher struct {
+	// Data is the content of the file that the operators were loaded
+	// from. Changes are detected against it, so that a change made after
+	// the operators were loaded isn't missed.
+	Data      []byte
+	File      string
+	Interval  time.Duration
+	Operators []ConfigReloader
+}
+
+// Start implements manager.Runnable
+func (w *ConfigWatcher) Start(stop <-chan struct{}) error {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.poll()
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// poll reloads the operators if the content of the file has changed. An
+// invalid file isn't reloaded again until it changes, and the operators
+// keep their rules in the meantime.
+func (w *ConfigWatcher) poll() {
+	data, err := ioutil.ReadFile(w.File)
+	if err != nil {
+		log.Error(err, "error reading config file", "file", w.File)
+		return
+	}
+	if bytes.Equal(data, w.Data) {
+		return
+	}
+	w.Data = data
+
+	log.Info("config file changed, reloading", "file", w.File)
+	for _, o := range w.Operators {
+		if err := o.ReloadConfig(data); err != nil {
+			log.Error(err, "error reloading config file, the previous rules are still in use", "file", w.File)
+		}
+	}
+}
+
+// logRuleChanges logs the rules that were removed and added between two
+// lists of rules and returns true if there were any. Both must be slices of
+// structs.
+func logRuleChanges(log logr.Logger, previous, current interface{}) bool {
+	changed := false
+	for _, rule := range ruleDifference(previous, current) {
+		log.Info("rule removed", "rule", rule)
+		changed = true
+	}
+	for _, rule := range ruleDifference(current, previous) {
+		log.Info("rule added", "rule", rule)
+		changed = true
+	}
+
+	return changed
+}
+
+// ruleDifference returns the rules in a that aren't in b
+func ruleDifference(a, b interface{}) []interface{} {
+	av := reflect.ValueOf(a)
+	bv := reflect.ValueOf(b)
+
+	var difference []interface{}
+	for i := 0; i < av.Len(); i++ {
+		found := false
+		for j := 0; j < bv.Len(); j++ {
+			if ruleEqual(av.Index(i), bv.Index(j)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			difference = append(difference, av.Index(i).Interface())
+		}
+	}
+
+	return difference
+}
+
+// ruleEqual returns true if the exported fields of two rules are equal. The
+// unexported fields are derived from where the rule was loaded, such as its
+// position in the file, which doesn't change what it permits.
+func ruleEqual(a, b reflect.Value) bool {
+	for i := 0; i < a.NumField(); i++ {
+		if a.Type().Field(i).PkgPath != "" {
+			continue
+		}
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// requeue sends an event for each of the requests to the channel watched by
+// a controller, so that they're reconciled again. Nothing is sent if the
+// controller hasn't been set up.
+func requeue(events chan<- event.GenericEvent, requests []reconcile.Request) {
+	if events == nil {
+		return
+	}
+
+	for _, req := range requests {
+		serviceAccount := &corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: req.Namespace,
+				Name:      req.Name,
+			},
+		}
+		events <- event.GenericEvent{Meta: serviceAccount, Object: serviceAccount}
+	}
+}
@@ -0,0 +1,194 @@
+package operator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+type fakeConfigReloader struct {
+	data [][]byte
+}
+
+func (r *fakeConfigReloader) ReloadConfig(data []byte) error {
+	r.data = append(r.data, data)
+	return nil
+}
+
+func TestConfigWatcherPoll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Mimic the symlinks of a mounted ConfigMap
+	if err := os.Mkdir(filepath.Join(dir, "v1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "v1", "config.yaml"), []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("v1", filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join("..data", "config.yaml"), filepath.Join(dir, "config.yaml")); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &fakeConfigReloader{}
+	w := &ConfigWatcher{
+		Data:      []byte("v1"),
+		File:      filepath.Join(dir, "config.yaml"),
+		Operators: []ConfigReloader{r},
+	}
+
+	// Unchanged files aren't reloaded
+	w.poll()
+	assert.Empty(t, r.data)
+
+	// Swap the symlink to a new version
+	if err := os.Mkdir(filepath.Join(dir, "v2"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "v2", "config.yaml"), []byte("v2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("v2", filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+
+	w.poll()
+	assert.Equal(t, [][]byte{[]byte("v2")}, r.data)
+
+	// The new version is only reloaded once
+	w.poll()
+	assert.Len(t, r.data, 1)
+}
+
+func TestAWSOperatorReloadConfig(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = corev1.AddToScheme(scheme)
+
+	o := &AWSOperator{
+		AWSOperatorConfig: &AWSOperatorConfig{
+			Config: &Config{
+				KubeClient: fake.NewFakeClientWithScheme(scheme,
+					&corev1.ServiceAccount{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:        "foo",
+							Namespace:   "bar",
+							Annotations: map[string]string{awsRoleAnnotation: "arn:aws:iam::111111111111:role/foo"},
+						},
+					},
+					&corev1.ServiceAccount{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:      "default",
+							Namespace: "bar",
+						},
+					},
+				),
+			},
+		},
+		log: log.WithName("aws"),
+		rules: AWSRules{
+			AWSRule{
+				NamespacePatterns: []string{"bar"},
+				RoleNamePatterns:  []string{"*"},
+				source:            "aws.rules[0]",
+			},
+		},
+		reconcileEvents: make(chan event.GenericEvent, 10),
+	}
+	previous := o.rules
+
+	// Invalid rules aren't loaded
+	assert.Error(t, o.ReloadConfig([]byte(`
+aws:
+  rules:
+    - namespacePatterns:
+        - "bar["
+      roleNamePatterns:
+        - "*"
+`)))
+	assert.Error(t, o.ReloadConfig([]byte(`
+aws:
+  rules:
+    - namespacePatterns:
+        - bar
+      credentialTypes:
+        - foo
+`)))
+	assert.Error(t, o.ReloadConfig([]byte(`aws: [`)))
+	assert.Equal(t, previous, o.rules)
+	assert.Len(t, o.reconcileEvents, 0)
+
+	// Unchanged rules don't reconcile anything
+	assert.NoError(t, o.ReloadConfig([]byte(`
+aws:
+  rules:
+    - namespacePatterns:
+        - bar
+      roleNamePatterns:
+        - "*"
+`)))
+	assert.Len(t, o.reconcileEvents, 0)
+
+	// Changed rules reconcile every annotated service account
+	assert.NoError(t, o.ReloadConfig([]byte(`
+aws:
+  rules:
+    - namespacePatterns:
+        - bar
+      roleNamePatterns:
+        - foo-*
+`)))
+	assert.Equal(t, AWSRules{
+		AWSRule{
+			NamespacePatterns: []string{"bar"},
+			RoleNamePatterns:  []string{"foo-*"},
+			source:            "aws.rules[0]",
+		},
+	}, o.rules)
+	if assert.Len(t, o.reconcileEvents, 1) {
+		e := <-o.reconcileEvents
+		assert.Equal(t, "bar", e.Meta.GetNamespace())
+		assert.Equal(t, "foo", e.Meta.GetName())
+	}
+}
+
+func TestRuleDifference(t *testing.T) {
+	a := AWSRules{
+		AWSRule{NamespacePatterns: []string{"foo"}},
+		AWSRule{NamespacePatterns: []string{"bar"}},
+	}
+	b := AWSRules{
+		AWSRule{NamespacePatterns: []string{"bar"}},
+		AWSRule{NamespacePatterns: []string{"baz"}},
+	}
+
+	assert.Equal(t, []interface{}{AWSRule{NamespacePatterns: []string{"foo"}}}, ruleDifference(a, b))
+	assert.Equal(t, []interface{}{AWSRule{NamespacePatterns: []string{"baz"}}}, ruleDifference(b, a))
+	assert.Empty(t, ruleDifference(a, a))
+
+	// Rules that have only moved aren't different
+	moved := AWSRules{
+		AWSRule{NamespacePatterns: []string{"foo"}, source: "aws.rules[1]"},
+	}
+	assert.Empty(t, ruleDifference(moved, AWSRules{
+		AWSRule{NamespacePatterns: []string{"foo"}, source: "aws.rules[0]"},
+	}))
+}
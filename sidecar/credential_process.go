@@ -0,0 +1,82 @@
+package sidecar
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// awsCredentialProcessOutput is the format that the AWS CLI and SDKs expect
+// a credential_process to write to stdout
+type awsCredentialProcessOutput struct {
+	Version         int       `json:"Version"`
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	SessionToken    string    `json:"SessionToken,omitempty"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+// writeAWSCredentialProcess writes the credentials to w in the credential_process
+// format
+func writeAWSCredentialProcess(w io.Writer, creds *AWSCredentials) error {
+	return json.NewEncoder(w).Encode(&awsCredentialProcessOutput{
+		Version:         1,
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.Token,
+		Expiration:      creds.Expiration,
+	})
+}
+
+// AWSCredentialProcess logs in to vault, retrieves a set of AWS credentials
+// and writes them to w in the format expected from a credential_process
+func (s *Sidecar) AWSCredentialProcess(w io.Writer) error {
+	apc, ok := s.ProviderConfig.(*AWSProviderConfig)
+	if !ok {
+		return fmt.Errorf("credential process requires an AWS provider config")
+	}
+
+	if _, err := s.renew(apc); err != nil {
+		return err
+	}
+
+	return writeAWSCredentialProcess(w, apc.load().creds)
+}
+
+// AWSCredentialProcessFromSidecar retrieves AWS credentials from the
+// /credentials endpoint of an aws-sidecar that is already running, rather
+// than from vault, and writes them to w in the format expected from a
+// credential_process. The authorization token is optional.
+func AWSCredentialProcessFromSidecar(url, authorizationToken string, w io.Writer) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if authorizationToken != "" {
+		req.Header.Set("Authorization", authorizationToken)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		e := &awsError{}
+		if err := json.NewDecoder(resp.Body).Decode(e); err != nil {
+			return fmt.Errorf("unexpected response from %s: %s", url, resp.Status)
+		}
+		return fmt.Errorf("unexpected response from %s: %s: %s", url, e.Code, e.Message)
+	}
+
+	creds := &AWSCredentials{}
+	if err := json.NewDecoder(resp.Body).Decode(creds); err != nil {
+		return err
+	}
+
+	return writeAWSCredentialProcess(w, creds)
+}
@@ -0,0 +1,57 @@
+package sidecar
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestAWSCredentialProcessFromSidecar tests that credentials retrieved from a
+// sidecar are converted into the credential_process format
+func TestAWSCredentialProcessFromSidecar(t *testing.T) {
+	expiration := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	apc := &AWSProviderConfig{
+		AuthorizationToken: "foobar",
+	}
+	apc.store(&awsState{
+		creds: &AWSCredentials{
+			AccessKeyID:     "AKIAFOOBAR",
+			SecretAccessKey: "secret",
+			Token:           "token",
+			Expiration:      expiration,
+		},
+	})
+
+	r := mux.NewRouter()
+	apc.setupEndpoints(r, 0)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	// Test that the error from the sidecar is returned
+	var out bytes.Buffer
+	err := AWSCredentialProcessFromSidecar(ts.URL+"/credentials", "", &out)
+	assert.EqualError(t, err, "unexpected response from "+ts.URL+"/credentials: Unauthorized: Authorization token is missing or invalid")
+	assert.Empty(t, out.String())
+
+	// Test that the credentials are written in the expected format
+	err = AWSCredentialProcessFromSidecar(ts.URL+"/credentials", "foobar", &out)
+	assert.NoError(t, err)
+
+	output := &awsCredentialProcessOutput{}
+	if err := json.Unmarshal(out.Bytes(), output); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, &awsCredentialProcessOutput{
+		Version:         1,
+		AccessKeyID:     "AKIAFOOBAR",
+		SecretAccessKey: "secret",
+		SessionToken:    "token",
+		Expiration:      expiration,
+	}, output)
+}
@@ -0,0 +1,140 @@
+package sidecar
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// forwardedSignals are passed on from the sidecar to the child process
+var forwardedSignals = []os.Signal{
+	syscall.SIGHUP,
+	syscall.SIGINT,
+	syscall.SIGQUIT,
+	syscall.SIGTERM,
+	syscall.SIGUSR1,
+	syscall.SIGUSR2,
+}
+
+// Exec runs a child process with an environment that points it at the
+// provider endpoints, which are served on an ephemeral loopback port. The
+// credentials are renewed in the background until the child exits. Signals
+// received by the sidecar are forwarded to the child and the exit code of the
+// child is returned. The child isn't started until the first set of
+// credentials has been retrieved, which is abandoned if ctx is done, if the
+// sidecar receives a signal or if the operational endpoints can't be served.
+// The child is killed if ctx is done while it's running.
+func (s *Sidecar) Exec(ctx context.Context, name string, args []string) (int, error) {
+	// Random is used for the backoff and the interval between renewal
+	// attempts
+	rand.Seed(int64(time.Now().Nanosecond()))
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, forwardedSignals...)
+	defer signal.Stop(signals)
+
+	stop := make(chan struct{})
+	ready, done := s.startRenewals(stop)
+
+	errors := make(chan error, 1)
+
+	// Serve operational endpoints, if configured
+	var opsServer *http.Server
+	if s.OpsAddress != "" {
+		opsServer = &http.Server{Addr: s.OpsAddress, Handler: s.opsHandler()}
+		go func() {
+			log.Info("operational status server is listening", "address", s.OpsAddress)
+			if err := opsServer.ListenAndServe(); err != http.ErrServerClosed {
+				errors <- err
+			}
+		}()
+	}
+
+	providerServer := &http.Server{Handler: s.providerHandler()}
+
+	// Stop serving and renewing and revoke the credentials once the child
+	// has exited
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout())
+		defer cancel()
+
+		if err := providerServer.Shutdown(ctx); err != nil {
+			log.Error(err, "error shutting down webserver")
+		}
+
+		close(stop)
+		s.revoke(ctx, done)
+
+		if opsServer != nil {
+			if err := opsServer.Shutdown(ctx); err != nil {
+				log.Error(err, "error shutting down operational status server")
+			}
+		}
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 1, err
+	}
+
+	// Block until the provider has retrieved the first set of credentials
+	select {
+	case <-ready:
+	case err := <-errors:
+		listener.Close()
+		return 1, err
+	case <-ctx.Done():
+		listener.Close()
+		return 1, fmt.Errorf("error retrieving the first set of credentials: %w", ctx.Err())
+	case sig := <-signals:
+		listener.Close()
+		return 1, fmt.Errorf("received %s before the first set of credentials was retrieved", sig)
+	}
+
+	go func() {
+		log.Info("webserver is listening", "address", listener.Addr().String())
+		if err := providerServer.Serve(listener); err != http.ErrServerClosed {
+			log.Error(err, "error serving provider endpoints")
+		}
+	}()
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), s.ProviderConfig.env(listener.Addr().String())...)
+
+	if err := cmd.Start(); err != nil {
+		return 1, err
+	}
+
+	go func() {
+		for sig := range signals {
+			if err := cmd.Process.Signal(sig); err != nil {
+				log.Error(err, "error forwarding signal to child process", "signal", sig.String())
+			}
+		}
+	}()
+
+	if err := cmd.Wait(); err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return 1, err
+		}
+		// Follow the shell convention for children killed by a
+		// signal
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal()), nil
+		}
+		return exitErr.ExitCode(), nil
+	}
+
+	return 0, nil
+}
@@ -2,6 +2,7 @@ package sidecar
 
 import (
 	"fmt"
+	"net/http"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/utilitywarehouse/go-operational/op"
@@ -15,14 +16,24 @@ const (
 )
 
 var (
-	promExpiry = prometheus.NewGauge(prometheus.GaugeOpts{
+	promExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: prometheus.BuildFQName(promNamespace, promSubsystem, "expiry_timestamp_seconds"),
-		Help: "Returns the expiry date for the current credentials, expressed as a Unix Epoch Time",
-	})
+		Help: "Returns the expiry date for the current credentials, by name, expressed as a Unix Epoch Time",
+	},
+		[]string{"name"},
+	)
 	promRenewals = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: prometheus.BuildFQName(promNamespace, promSubsystem, "renewals_total"),
 		Help: "Total count of renewals",
 	})
+	promLogins = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(promNamespace, promSubsystem, "vault_logins_total"),
+		Help: "Total count of logins to Vault with the service account token",
+	})
+	promTokenRenewals = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(promNamespace, promSubsystem, "vault_token_renewals_total"),
+		Help: "Total count of renewals of the Vault token",
+	})
 	promRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: prometheus.BuildFQName(promNamespace, promSubsystem, "requests_total"),
 		Help: "Total count of requests handled, by code and method",
@@ -71,23 +82,40 @@ var (
 	},
 		[]string{},
 	)
-	statusHandler = op.NewHandler(
-		op.NewStatus(appName, appDescription).
-			AddOwner("system", "#infra").
-			AddLink("readme", fmt.Sprintf("https://github.com/utilitywarehouse/%s/blob/master/README.md", appName)).
-			AddMetrics(
-				promExpiry,
-				promRenewals,
-				promRequests,
-				promRequestsDuration,
-				promRequestsInFlight,
-				promRequestSize,
-				promResponseSize,
-				promErrors,
-				promVaultRequests,
-				promVaultRequestsDuration,
-				promVaultRequestsInFlight,
-			).
-			ReadyAlways(),
-	)
 )
+
+// newStatusHandler returns a handler that serves the operational endpoints,
+// with health and readiness reflecting the status of the renewals
+func newStatusHandler(renewals []*renewal) http.Handler {
+	status := op.NewStatus(appName, appDescription).
+		AddOwner("system", "#infra").
+		AddLink("readme", fmt.Sprintf("https://github.com/utilitywarehouse/%s/blob/master/README.md", appName)).
+		AddMetrics(
+			promExpiry,
+			promRenewals,
+			promLogins,
+			promTokenRenewals,
+			promRequests,
+			promRequestsDuration,
+			promRequestsInFlight,
+			promRequestSize,
+			promResponseSize,
+			promErrors,
+			promVaultRequests,
+			promVaultRequestsDuration,
+			promVaultRequestsInFlight,
+		)
+
+	for _, r := range renewals {
+		status.AddChecker(r.renewer.name()+" credentials", r.status.check)
+	}
+
+	return op.NewHandler(status.Ready(func() bool {
+		for _, r := range renewals {
+			if !r.status.ready() {
+				return false
+			}
+		}
+		return true
+	}))
+}
@@ -0,0 +1,52 @@
+package sidecar
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	// ErrLogin is wrapped by errors from RunOnce when the sidecar fails to
+	// login to vault
+	ErrLogin = errors.New("error logging in to vault")
+	// ErrCredentials is wrapped by errors from RunOnce when the sidecar
+	// fails to retrieve credentials from vault
+	ErrCredentials = errors.New("error retrieving credentials")
+	// ErrOutput is wrapped by errors from RunOnce when the sidecar fails to
+	// write the credentials
+	ErrOutput = errors.New("error writing credentials")
+)
+
+// RunOnce logs in to vault, retrieves each set of credentials once and writes
+// them to the credentials file, or to w if there isn't one. The returned
+// error wraps ErrLogin, ErrCredentials or ErrOutput, indicating the stage
+// that failed.
+func (s *Sidecar) RunOnce(w io.Writer) error {
+	if err := s.login(); err != nil {
+		return fmt.Errorf("%w: %v", ErrLogin, err)
+	}
+
+	for _, r := range s.renewals {
+		if _, err := r.renewer.renew(s.vaultClient); err != nil {
+			return fmt.Errorf("%w: %v", ErrCredentials, err)
+		}
+	}
+
+	if s.CredentialsFile != "" {
+		if err := s.writeCredentialsFile(); err != nil {
+			return fmt.Errorf("%w: %v", ErrOutput, err)
+		}
+		return nil
+	}
+
+	data, err := s.ProviderConfig.marshal(s.CredentialsFormat)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrOutput, err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("%w: %v", ErrOutput, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package sidecar
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newOnceTestSidecar returns a sidecar for aws credentials that writes them
+// to the given file, in the env format
+func newOnceTestSidecar(t *testing.T, tokenPath, credentialsFile string) *Sidecar {
+	s, err := New(&Config{
+		CredentialsFile:   credentialsFile,
+		CredentialsFormat: "env",
+		KubeAuthPath:      "kubernetes",
+		KubeAuthRole:      "vkcc_aws_bar_foo",
+		ProviderConfig: &AWSProviderConfig{
+			Path: "aws",
+			Role: "vkcc_aws_bar_foo",
+		},
+		TokenPath: tokenPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// TestSidecarRunOnce tests that the credentials are written to the
+// credentials file, or to the writer if there isn't one
+func TestSidecarRunOnce(t *testing.T) {
+	ts := newFakeVaultServer(t)
+	defer ts.Close()
+
+	tokenPath := newFakeTokenFile(t)
+	dir := filepath.Dir(tokenPath)
+	defer os.RemoveAll(dir)
+
+	credentials := "AWS_ACCESS_KEY_ID=AKIAFOOBAR\nAWS_SECRET_ACCESS_KEY=secret\nAWS_SESSION_TOKEN=token\n"
+
+	var b bytes.Buffer
+	s := newOnceTestSidecar(t, tokenPath, filepath.Join(dir, "credentials"))
+	if assert.NoError(t, s.RunOnce(&b)) {
+		data, err := ioutil.ReadFile(s.CredentialsFile)
+		assert.NoError(t, err)
+		assert.Equal(t, credentials, string(data))
+		assert.Empty(t, b.String())
+	}
+
+	s = newOnceTestSidecar(t, tokenPath, "")
+	if assert.NoError(t, s.RunOnce(&b)) {
+		assert.Equal(t, credentials, b.String())
+	}
+}
+
+// TestSidecarRunOnceErrors tests that the errors returned by RunOnce wrap
+// the error for the stage that failed
+func TestSidecarRunOnceErrors(t *testing.T) {
+	ts := newFakeVaultServer(t)
+	defer ts.Close()
+
+	var failPrefix string
+	fs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, failPrefix) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		ts.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer fs.Close()
+	os.Setenv("VAULT_ADDR", fs.URL)
+
+	tokenPath := newFakeTokenFile(t)
+	dir := filepath.Dir(tokenPath)
+	defer os.RemoveAll(dir)
+
+	credentialsFile := filepath.Join(dir, "credentials")
+
+	failPrefix = "/v1/auth/kubernetes/login"
+	err := newOnceTestSidecar(t, tokenPath, credentialsFile).RunOnce(ioutil.Discard)
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, ErrLogin), err.Error())
+	}
+
+	failPrefix = "/v1/aws/sts/"
+	err = newOnceTestSidecar(t, tokenPath, credentialsFile).RunOnce(ioutil.Discard)
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, ErrCredentials), err.Error())
+	}
+
+	// The directory of the credentials file doesn't exist
+	failPrefix = "/v1/none"
+	err = newOnceTestSidecar(t, tokenPath, filepath.Join(dir, "missing", "credentials")).RunOnce(ioutil.Discard)
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, ErrOutput), err.Error())
+	}
+}
@@ -1,6 +1,7 @@
 package sidecar
 
 import (
+	"errors"
 	"net/http"
 	"time"
 
@@ -8,13 +9,44 @@ import (
 	vault "github.com/hashicorp/vault/api"
 )
 
+// renewer retrieves a set of credentials from vault. Each set of credentials
+// served by a provider is renewed independently.
+type renewer interface {
+	// name identifies the credentials in logs and metrics
+	name() string
+	// renew retrieves new credentials and returns the time they expire
+	renew(client *vault.Client) (time.Time, error)
+	// revoke revokes the lease of the current credentials, if they have
+	// one
+	revoke(client *vault.Client) error
+}
+
 // ProviderConfig provides generic methods for retrieving and serving
 // credentials from vault for a cloud provider
 type ProviderConfig interface {
-	renew(client *vault.Client) (time.Duration, error)
-	setupEndpoints(r *mux.Router)
+	// renewers returns the sets of credentials served by the provider
+	renewers() []renewer
+	// setupEndpoints adds the provider endpoints to the router. They
+	// refuse to serve credentials that expire within the margin.
+	setupEndpoints(r *mux.Router, margin time.Duration)
+	// marshal returns the current credentials in the given format. An
+	// empty format selects the default format for the provider.
+	marshal(format string) ([]byte, error)
+	// env returns the environment variables that point a process at the
+	// provider endpoints served on the given address
+	env(address string) []string
 }
 
+// expiresWithin returns true if the expiry time is less than the margin
+// away
+func expiresWithin(expiry time.Time, margin time.Duration) bool {
+	return !time.Now().Add(margin).Before(expiry)
+}
+
+// errUnsupportedFormat is returned by marshal when the provider doesn't
+// support the requested format
+var errUnsupportedFormat = errors.New("unsupported credentials format")
+
 // providerError is an error that can be returned as a http response
 type providerError interface {
 	write(http.ResponseWriter, string, int) error
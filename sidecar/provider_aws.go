@@ -1,17 +1,36 @@
 package sidecar
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
 	vault "github.com/hashicorp/vault/api"
 )
 
+// The types of credentials that an aws secret role can issue
+const (
+	AWSCredentialTypeAssumedRole     = "assumed_role"
+	AWSCredentialTypeFederationToken = "federation_token"
+	AWSCredentialTypeIAMUser         = "iam_user"
+)
+
+// awsLeaseMinExtension is how much a lease renewal must extend the expiry of
+// iam user credentials by. New credentials are read when the lease is near
+// its max ttl and renewing it doesn't extend it any further.
+const awsLeaseMinExtension = time.Minute
+
 // AWSCredentials are the credentials served by the API
 type AWSCredentials struct {
 	AccessKeyID     string    `json:"AccessKeyId"`
@@ -45,73 +64,460 @@ type AWSProviderConfig struct {
 	Path    string
 	RoleArn string
 	Role    string
+	// CredentialType is the type of credentials to retrieve from the
+	// role: assumed_role (default), federation_token or iam_user. The
+	// additional roles are always assumed roles.
+	CredentialType string
+	// Roles are additional roles, served at /credentials/<name> and as
+	// named profiles in the credentials file. They're renewed
+	// independently of the default role.
+	Roles []*AWSRole
+
+	// IMDS enables endpoints that emulate the EC2 instance metadata
+	// service, in addition to /credentials
+	IMDS bool
+	// IMDSv2Required rejects metadata requests that don't present a
+	// session token retrieved from /latest/api/token
+	IMDSv2Required bool
+	// Region is served by the metadata service at
+	// /latest/meta-data/placement/region
+	Region string
+	// AuthorizationToken, when set, must be presented in the Authorization
+	// header of requests to /credentials
+	AuthorizationToken string
+	// Profile is the name of the profile in the credentials file
+	Profile string
+
+	// state holds the current *awsState. It's replaced, rather than
+	// modified, by renew and revoke so that the handlers always see a
+	// consistent set of credentials.
+	state        atomic.Value
+	imdsSessions imdsSessions
+}
+
+// AWSRole is an additional role that the AWS provider retrieves credentials
+// for, served as a named profile
+type AWSRole struct {
+	Name    string
+	RoleArn string
+	Role    string
+
+	// state holds the current *awsState, like AWSProviderConfig.state
+	state atomic.Value
+}
+
+// awsState is an immutable snapshot of the credentials served by the AWS
+// provider
+type awsState struct {
+	creds       *AWSCredentials
+	leaseID     string
+	renewable   bool
+	lastUpdated time.Time
+}
+
+// load returns the current state. The credentials in the returned state are
+// nil if they haven't been retrieved yet.
+func (apc *AWSProviderConfig) load() *awsState {
+	return loadAWSState(&apc.state)
+}
+
+// store replaces the current state
+func (apc *AWSProviderConfig) store(state *awsState) {
+	apc.state.Store(state)
+}
 
-	creds *AWSCredentials
+// load returns the current state of the role
+func (ar *AWSRole) load() *awsState {
+	return loadAWSState(&ar.state)
+}
+
+// store replaces the current state of the role
+func (ar *AWSRole) store(state *awsState) {
+	ar.state.Store(state)
+}
+
+// loadAWSState returns the *awsState held by v, or an empty state if there
+// isn't one
+func loadAWSState(v *atomic.Value) *awsState {
+	state, ok := v.Load().(*awsState)
+	if !ok {
+		return &awsState{}
+	}
+
+	return state
+}
+
+// profile returns the name of the profile that the default role is served as
+func (apc *AWSProviderConfig) profile() string {
+	if apc.Profile == "" {
+		return "default"
+	}
+
+	return apc.Profile
+}
+
+// credentialType returns the type of credentials retrieved for the default
+// role
+func (apc *AWSProviderConfig) credentialType() string {
+	if apc.CredentialType == "" {
+		return AWSCredentialTypeAssumedRole
+	}
+
+	return apc.CredentialType
+}
+
+// renewers returns the default role and the additional roles, so that they
+// are each renewed independently
+func (apc *AWSProviderConfig) renewers() []renewer {
+	renewers := []renewer{apc}
+	for _, role := range apc.Roles {
+		renewers = append(renewers, &awsRoleRenewer{path: apc.Path, role: role})
+	}
+
+	return renewers
+}
+
+// name returns the profile name of the default role
+func (apc *AWSProviderConfig) name() string {
+	return apc.profile()
 }
 
 // renew retrieves credentials from vault for the secret indicated in
-// the configuration
-func (apc *AWSProviderConfig) renew(client *vault.Client) (time.Duration, error) {
-	// Get a credentials secret from vault for the role
+// the configuration. The lease of iam user credentials is renewed instead,
+// for as long as vault extends it, because every read creates a new user.
+func (apc *AWSProviderConfig) renew(client *vault.Client) (time.Time, error) {
+	current := apc.load()
+	if apc.credentialType() == AWSCredentialTypeIAMUser && current.creds != nil && current.renewable {
+		state, err := renewAWSLease(client, current)
+		if err == nil && state.creds.Expiration.After(current.creds.Expiration.Add(awsLeaseMinExtension)) {
+			apc.store(state)
+			return state.creds.Expiration, nil
+		}
+		if err != nil {
+			log.Error(err, "error renewing aws credentials lease, reading new credentials", "lease_id", current.leaseID)
+		}
+	}
+
+	state, err := readAWSCredentials(client, apc.Path, apc.Role, apc.RoleArn, apc.credentialType())
+	if err != nil {
+		return time.Time{}, err
+	}
+	apc.store(state)
+
+	return state.creds.Expiration, nil
+}
+
+// revoke revokes the lease of the credentials for the default role
+func (apc *AWSProviderConfig) revoke(client *vault.Client) error {
+	if err := revokeAWSLease(client, apc.load().leaseID); err != nil {
+		return err
+	}
+	apc.store(&awsState{})
+
+	return nil
+}
+
+// awsRoleRenewer renews the credentials for one of the additional roles
+type awsRoleRenewer struct {
+	path string
+	role *AWSRole
+}
+
+// name returns the profile name of the role
+func (arr *awsRoleRenewer) name() string {
+	return arr.role.Name
+}
+
+// renew retrieves credentials from vault for the role
+func (arr *awsRoleRenewer) renew(client *vault.Client) (time.Time, error) {
+	state, err := readAWSCredentials(client, arr.path, arr.role.Role, arr.role.RoleArn, AWSCredentialTypeAssumedRole)
+	if err != nil {
+		return time.Time{}, err
+	}
+	arr.role.store(state)
+
+	return state.creds.Expiration, nil
+}
+
+// revoke revokes the lease of the credentials for the role
+func (arr *awsRoleRenewer) revoke(client *vault.Client) error {
+	if err := revokeAWSLease(client, arr.role.load().leaseID); err != nil {
+		return err
+	}
+	arr.role.store(&awsState{})
+
+	return nil
+}
+
+// readAWSCredentials retrieves credentials of the given type from the given
+// secret backend and role in vault, assuming roleArn if it's set
+func readAWSCredentials(client *vault.Client, path, role, roleArn, credentialType string) (*awsState, error) {
+	// Get a credentials secret from vault for the role. IAM users are
+	// created at /creds, the temporary credentials are issued at /sts.
+	endpoint := "/sts/"
+	if credentialType == AWSCredentialTypeIAMUser {
+		endpoint = "/creds/"
+	}
 	var secretData map[string][]string
-	if apc.RoleArn != "" {
+	if roleArn != "" {
 		secretData = map[string][]string{
-			"role_arn": []string{apc.RoleArn},
+			"role_arn": []string{roleArn},
 		}
 	}
-	secret, err := client.Logical().ReadWithData(apc.Path+"/sts/"+apc.Role, secretData)
+	secret, err := client.Logical().ReadWithData(path+endpoint+role, secretData)
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
 
-	// Convert the secret's lease duration into a time.Duration
-	leaseDuration := time.Duration(secret.LeaseDuration) * time.Second
-
 	// Get the expiration date of the lease from vault
 	l := lease{}
 	req := client.NewRequest("PUT", "/v1/sys/leases/lookup")
 	if err = req.SetJSONBody(map[string]interface{}{
 		"lease_id": secret.LeaseID,
 	}); err != nil {
-		return -1, err
+		return nil, err
 	}
 	resp, err := client.RawRequest(req)
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
 	err = json.NewDecoder(resp.Body).Decode(&l)
 	io.Copy(ioutil.Discard, resp.Body)
 	resp.Body.Close()
 	if err != nil {
-		return -1, err
+		return nil, err
+	}
+
+	log.Info("new aws credentials", "credential_type", credentialType, "role_arn", roleArn, "access_key", secret.Data["access_key"].(string), "expiration", l.Data.ExpireTime.Format("2006-01-02 15:04:05"))
+
+	// There isn't a security token for iam users
+	token, _ := secret.Data["security_token"].(string)
+
+	return &awsState{
+		creds: &AWSCredentials{
+			AccessKeyID:     secret.Data["access_key"].(string),
+			SecretAccessKey: secret.Data["secret_key"].(string),
+			Token:           token,
+			Expiration:      l.Data.ExpireTime,
+		},
+		leaseID:     secret.LeaseID,
+		renewable:   secret.Renewable,
+		lastUpdated: time.Now(),
+	}, nil
+}
+
+// renewAWSLease renews the lease of the credentials in the given state,
+// returning a state with the same credentials and the new expiry
+func renewAWSLease(client *vault.Client, state *awsState) (*awsState, error) {
+	secret, err := client.Sys().Renew(state.leaseID, 0)
+	if err != nil {
+		return nil, err
 	}
 
-	log.Info("new aws credentials", "access_key", secret.Data["access_key"].(string), "expiration", l.Data.ExpireTime.Format("2006-01-02 15:04:05"))
+	creds := *state.creds
+	creds.Expiration = time.Now().Add(time.Duration(secret.LeaseDuration) * time.Second)
 
-	apc.creds = &AWSCredentials{
-		AccessKeyID:     secret.Data["access_key"].(string),
-		SecretAccessKey: secret.Data["secret_key"].(string),
-		Token:           secret.Data["security_token"].(string),
-		Expiration:      l.Data.ExpireTime,
+	log.Info("renewed aws credentials lease", "lease_id", state.leaseID, "access_key", creds.AccessKeyID, "expiration", creds.Expiration.Format("2006-01-02 15:04:05"))
+
+	return &awsState{
+		creds:       &creds,
+		leaseID:     state.leaseID,
+		renewable:   secret.Renewable,
+		lastUpdated: time.Now(),
+	}, nil
+}
+
+// revokeAWSLease revokes the given lease, if it isn't empty. The lease id is
+// in the path, rather than the body, so that the policy can restrict which
+// leases can be revoked.
+func revokeAWSLease(client *vault.Client, leaseID string) error {
+	if leaseID == "" {
+		return nil
 	}
 
-	return leaseDuration, nil
+	if _, err := client.Logical().Write("sys/leases/revoke/"+leaseID, nil); err != nil {
+		return err
+	}
+	log.Info("revoked aws credentials lease", "lease_id", leaseID)
+
+	return nil
+}
+
+// setupEndpoints adds a handler that serves the credentials for the default
+// role at /credentials, handlers for every role at /credentials/<name> and,
+// if enabled, the endpoints that emulate the EC2 metadata service
+func (apc *AWSProviderConfig) setupEndpoints(r *mux.Router, margin time.Duration) {
+	if apc.IMDS {
+		apc.setupIMDSEndpoints(r, margin)
+	}
+
+	r.HandleFunc("/credentials", apc.credentialsHandler(apc.load, margin))
+	r.HandleFunc("/credentials/"+apc.profile(), apc.credentialsHandler(apc.load, margin))
+	for _, role := range apc.Roles {
+		r.HandleFunc("/credentials/"+role.Name, apc.credentialsHandler(role.load, margin))
+	}
 }
 
-// setupEndpoints adds a handler that serves the credentials at /credentials
-func (apc *AWSProviderConfig) setupEndpoints(r *mux.Router) {
-	r.HandleFunc("/credentials", func(w http.ResponseWriter, r *http.Request) {
+// credentialsHandler returns a handler that serves the credentials in the
+// state returned by load
+func (apc *AWSProviderConfig) credentialsHandler(load func() *awsState, margin time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
+		if !apc.authorized(r) {
+			httpError(w, "Authorization token is missing or invalid", http.StatusUnauthorized, &awsError{})
+			return
+		}
 		enc := json.NewEncoder(w)
-		if apc.creds == nil {
+		creds := load().creds
+		if creds == nil {
 			httpError(w, "Credentials not initialized", http.StatusNotFound, &awsError{})
 			return
 		}
-		if err := enc.Encode(apc.creds); err != nil {
+		if expiresWithin(creds.Expiration, margin) {
+			httpError(w, "Credentials have expired", http.StatusServiceUnavailable, &awsError{})
+			return
+		}
+		if err := enc.Encode(creds); err != nil {
 			httpError(w, "Error encoding credentials response as json", http.StatusInternalServerError, &awsError{})
 			return
 		}
-	})
+	}
+}
+
+// marshal returns the credentials in one of these formats:
+//   - ini (default): a shared credentials file, as read from ~/.aws/credentials
+//   - json: the format served at /credentials
+//   - credential-process: the format expected from a credential_process
+//   - env: AWS_* environment variables, one per line
+//
+// Only the ini format supports additional roles, which are written as named
+// profiles once their credentials have been retrieved.
+func (apc *AWSProviderConfig) marshal(format string) ([]byte, error) {
+	switch format {
+	case "", "ini":
+		return apc.marshalINI()
+	case "json", "credential-process", "env":
+		if len(apc.Roles) > 0 {
+			return nil, fmt.Errorf("%w for aws with multiple roles: %s", errUnsupportedFormat, format)
+		}
+	default:
+		return nil, fmt.Errorf("%w for aws: %s", errUnsupportedFormat, format)
+	}
+
+	creds := apc.load().creds
+	if creds == nil {
+		return nil, fmt.Errorf("credentials not initialized")
+	}
+
+	var b bytes.Buffer
+	switch format {
+	case "json":
+		if err := json.NewEncoder(&b).Encode(creds); err != nil {
+			return nil, err
+		}
+	case "credential-process":
+		if err := writeAWSCredentialProcess(&b, creds); err != nil {
+			return nil, err
+		}
+	case "env":
+		fmt.Fprintf(&b, "AWS_ACCESS_KEY_ID=%s\n", creds.AccessKeyID)
+		fmt.Fprintf(&b, "AWS_SECRET_ACCESS_KEY=%s\n", creds.SecretAccessKey)
+		if creds.Token != "" {
+			fmt.Fprintf(&b, "AWS_SESSION_TOKEN=%s\n", creds.Token)
+		}
+	}
+
+	return b.Bytes(), nil
+}
+
+// marshalINI returns a shared credentials file with a profile for each role
+// that has credentials
+func (apc *AWSProviderConfig) marshalINI() ([]byte, error) {
+	var b bytes.Buffer
+	writeProfile := func(profile string, creds *AWSCredentials) {
+		if creds == nil {
+			return
+		}
+		if b.Len() > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "[%s]\n", profile)
+		fmt.Fprintf(&b, "aws_access_key_id = %s\n", creds.AccessKeyID)
+		fmt.Fprintf(&b, "aws_secret_access_key = %s\n", creds.SecretAccessKey)
+		if creds.Token != "" {
+			fmt.Fprintf(&b, "aws_session_token = %s\n", creds.Token)
+		}
+	}
+
+	writeProfile(apc.profile(), apc.load().creds)
+	for _, role := range apc.Roles {
+		writeProfile(role.Name, role.load().creds)
+	}
+
+	if b.Len() == 0 {
+		return nil, fmt.Errorf("credentials not initialized")
+	}
+
+	return b.Bytes(), nil
+}
+
+// env points the AWS SDKs at /credentials
+func (apc *AWSProviderConfig) env(address string) []string {
+	env := []string{
+		"AWS_CONTAINER_CREDENTIALS_FULL_URI=http://" + address + "/credentials",
+	}
+	if apc.AuthorizationToken != "" {
+		env = append(env, "AWS_CONTAINER_AUTHORIZATION_TOKEN="+apc.AuthorizationToken)
+	}
+
+	return env
+}
+
+// authorized returns true if the request presents the authorization token in
+// the Authorization header, or if no token is configured
+func (apc *AWSProviderConfig) authorized(r *http.Request) bool {
+	if apc.AuthorizationToken == "" {
+		return true
+	}
+
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(apc.AuthorizationToken)) == 1
+}
+
+// ReadOrCreateAWSAuthorizationToken reads the authorization token from the
+// given file. If the file doesn't exist, or is empty, then a random token is
+// generated and written to it, so that it can be shared with the application
+// via AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE. The file is readable by its
+// owner and group, so that the application can read it through the fsGroup of
+// the pod.
+func ReadOrCreateAWSAuthorizationToken(file string) (string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if token := strings.TrimSpace(string(data)); token != "" {
+		return token, nil
+	}
+
+	token, err := GenerateAWSAuthorizationToken()
+	if err != nil {
+		return "", err
+	}
+
+	if err := writeFileAtomic(file, []byte(token), 0640); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// GenerateAWSAuthorizationToken returns a random authorization token
+func GenerateAWSAuthorizationToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
 // lease represents the part of the response from /v1/sys/leases/lookup we care about (the expire time)
@@ -0,0 +1,174 @@
+package sidecar
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/gorilla/mux"
+)
+
+const (
+	imdsTokenHeader    = "X-aws-ec2-metadata-token"
+	imdsTokenTTLHeader = "X-aws-ec2-metadata-token-ttl-seconds"
+	imdsMaxTokenTTL    = 21600
+)
+
+// imdsCredentials are the credentials served by the EC2 instance metadata
+// service at /latest/meta-data/iam/security-credentials/<role>
+type imdsCredentials struct {
+	Code            string    `json:"Code"`
+	LastUpdated     time.Time `json:"LastUpdated"`
+	Type            string    `json:"Type"`
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+// imdsSessions keeps track of the session tokens issued by the IMDSv2 token
+// endpoint and when they expire
+type imdsSessions struct {
+	mu     sync.Mutex
+	tokens map[string]time.Time
+}
+
+// issue returns a new session token that's valid for the given ttl
+func (s *imdsSessions) issue(ttl time.Duration) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tokens == nil {
+		s.tokens = make(map[string]time.Time)
+	}
+
+	// Take the opportunity to forget about expired tokens
+	now := time.Now()
+	for t, expiry := range s.tokens {
+		if now.After(expiry) {
+			delete(s.tokens, t)
+		}
+	}
+
+	s.tokens[token] = now.Add(ttl)
+
+	return token, nil
+}
+
+// valid returns true if the token was issued and hasn't expired
+func (s *imdsSessions) valid(token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expiry, ok := s.tokens[token]
+
+	return ok && time.Now().Before(expiry)
+}
+
+// imdsRoleName returns the name of the role reported by the metadata
+// service. This is the name of the role in the role arn if there is one,
+// otherwise the name of the secret role in vault.
+func (apc *AWSProviderConfig) imdsRoleName() string {
+	if a, err := arn.Parse(apc.RoleArn); err == nil {
+		resource := strings.Split(a.Resource, "/")
+		return resource[len(resource)-1]
+	}
+
+	return apc.Role
+}
+
+// imdsAuthorize wraps a handler that serves metadata, enforcing the session
+// token when one is provided in the request or when IMDSv2 is required
+func (apc *AWSProviderConfig) imdsAuthorize(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get(imdsTokenHeader)
+		if token == "" && !apc.IMDSv2Required {
+			next(w, r)
+			return
+		}
+		if !apc.imdsSessions.valid(token) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// setupIMDSEndpoints adds the endpoints required to masquerade as the EC2
+// instance metadata service. They don't require the authorization token,
+// because the SDKs don't send it to the metadata service.
+func (apc *AWSProviderConfig) setupIMDSEndpoints(r *mux.Router, margin time.Duration) {
+	r.HandleFunc("/latest/api/token", func(w http.ResponseWriter, r *http.Request) {
+		// Like the real service, refuse requests that have passed
+		// through a proxy
+		if r.Header.Get("X-Forwarded-For") != "" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		ttl, err := strconv.Atoi(r.Header.Get(imdsTokenTTLHeader))
+		if err != nil || ttl < 1 || ttl > imdsMaxTokenTTL {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		token, err := apc.imdsSessions.issue(time.Duration(ttl) * time.Second)
+		if err != nil {
+			http.Error(w, "Error generating token", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set(imdsTokenTTLHeader, strconv.Itoa(ttl))
+		w.Write([]byte(token))
+	}).Methods("PUT")
+	r.HandleFunc("/latest/meta-data/iam/security-credentials/", apc.imdsAuthorize(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(apc.imdsRoleName()))
+	})).Methods("GET")
+	r.HandleFunc("/latest/meta-data/iam/security-credentials/{role}", apc.imdsAuthorize(func(w http.ResponseWriter, r *http.Request) {
+		if mux.Vars(r)["role"] != apc.imdsRoleName() {
+			http.NotFound(w, r)
+			return
+		}
+		state := apc.load()
+		if state.creds == nil {
+			http.Error(w, "Credentials not initialized", http.StatusNotFound)
+			return
+		}
+		if expiresWithin(state.creds.Expiration, margin) {
+			http.Error(w, "Credentials have expired", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		if err := json.NewEncoder(w).Encode(&imdsCredentials{
+			Code:            "Success",
+			LastUpdated:     state.lastUpdated,
+			Type:            "AWS-HMAC",
+			AccessKeyID:     state.creds.AccessKeyID,
+			SecretAccessKey: state.creds.SecretAccessKey,
+			Token:           state.creds.Token,
+			Expiration:      state.creds.Expiration,
+		}); err != nil {
+			http.Error(w, "Error encoding credentials response as json", http.StatusInternalServerError)
+			return
+		}
+	})).Methods("GET")
+	r.HandleFunc("/latest/meta-data/placement/region", apc.imdsAuthorize(func(w http.ResponseWriter, r *http.Request) {
+		if apc.Region == "" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(apc.Region))
+	})).Methods("GET")
+}
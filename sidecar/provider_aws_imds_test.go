@@ -0,0 +1,120 @@
+package sidecar
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestAWSProviderConfigIMDS tests that the EC2 instance metadata endpoints
+// serve credentials and enforce session tokens
+func TestAWSProviderConfigIMDS(t *testing.T) {
+	apc := &AWSProviderConfig{
+		RoleArn:        "arn:aws:iam::111111111111:role/path/foobar-role",
+		Role:           "vkcc_aws_bar_foo",
+		IMDS:           true,
+		IMDSv2Required: true,
+		Region:         "eu-west-1",
+	}
+	apc.store(&awsState{
+		creds: &AWSCredentials{
+			AccessKeyID:     "AKIAFOOBAR",
+			SecretAccessKey: "secret",
+			Token:           "token",
+			Expiration:      time.Now().Add(time.Hour),
+		},
+	})
+
+	r := mux.NewRouter()
+	apc.setupEndpoints(r, 0)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	get := func(path, token string) *http.Response {
+		req, err := http.NewRequest("GET", ts.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set(imdsTokenHeader, token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// Test that a token is required
+	resp := get("/latest/meta-data/iam/security-credentials/", "")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// Test that an invalid token is rejected
+	resp = get("/latest/meta-data/iam/security-credentials/", "foobar")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// Test that a token without a ttl is rejected
+	req, err := http.NewRequest("PUT", ts.URL+"/latest/api/token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Retrieve a token
+	req.Header.Set(imdsTokenTTLHeader, "60")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "60", resp.Header.Get(imdsTokenTTLHeader))
+	token := string(body)
+	assert.NotEmpty(t, token)
+
+	// Test that the role name is listed
+	resp = get("/latest/meta-data/iam/security-credentials/", token)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "foobar-role", string(body))
+
+	// Test that the credentials are served for the role
+	resp = get("/latest/meta-data/iam/security-credentials/foobar-role", token)
+	creds := &imdsCredentials{}
+	err = json.NewDecoder(resp.Body).Decode(creds)
+	resp.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "Success", creds.Code)
+	assert.Equal(t, "AKIAFOOBAR", creds.AccessKeyID)
+	assert.Equal(t, "secret", creds.SecretAccessKey)
+	assert.Equal(t, "token", creds.Token)
+
+	// Test that other roles aren't found
+	resp = get("/latest/meta-data/iam/security-credentials/another-role", token)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// Test that the region is served
+	resp = get("/latest/meta-data/placement/region", token)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "eu-west-1", string(body))
+}
@@ -0,0 +1,404 @@
+package sidecar
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	vault "github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestAWSProviderConfigAuthorizationToken tests that requests to /credentials
+// must present the authorization token
+func TestAWSProviderConfigAuthorizationToken(t *testing.T) {
+	apc := &AWSProviderConfig{
+		AuthorizationToken: "foobar",
+	}
+	apc.store(&awsState{
+		creds: &AWSCredentials{
+			AccessKeyID:     "AKIAFOOBAR",
+			SecretAccessKey: "secret",
+			Token:           "token",
+			Expiration:      time.Now().Add(time.Hour),
+		},
+	})
+
+	r := mux.NewRouter()
+	apc.setupEndpoints(r, 0)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	get := func(token string) *http.Response {
+		req, err := http.NewRequest("GET", ts.URL+"/credentials", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// Test that a missing token is rejected in the awsError format
+	resp := get("")
+	awsErr := &awsError{}
+	err := json.NewDecoder(resp.Body).Decode(awsErr)
+	resp.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, "Unauthorized", awsErr.Code)
+
+	// Test that the wrong token is rejected
+	resp = get("barfoo")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// Test that the correct token is accepted
+	resp = get("foobar")
+	creds := &AWSCredentials{}
+	err = json.NewDecoder(resp.Body).Decode(creds)
+	resp.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "AKIAFOOBAR", creds.AccessKeyID)
+}
+
+// TestReadOrCreateAWSAuthorizationToken tests that a token is generated when
+// the file doesn't exist and read back when it does
+func TestReadOrCreateAWSAuthorizationToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "token")
+
+	token, err := ReadOrCreateAWSAuthorizationToken(file)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, token)
+
+	data, err := ioutil.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, token, string(data))
+
+	info, err := os.Stat(file)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	}
+
+	readToken, err := ReadOrCreateAWSAuthorizationToken(file)
+	assert.NoError(t, err)
+	assert.Equal(t, token, readToken)
+}
+
+// TestAWSProviderConfigMarshal tests that the credentials are rendered in
+// each of the supported formats
+func TestAWSProviderConfigMarshal(t *testing.T) {
+	apc := &AWSProviderConfig{
+		Profile: "foobar",
+	}
+
+	_, err := apc.marshal("")
+	assert.Error(t, err)
+
+	_, err = apc.marshal("yaml")
+	assert.True(t, errors.Is(err, errUnsupportedFormat))
+
+	apc.store(&awsState{
+		creds: &AWSCredentials{
+			AccessKeyID:     "AKIAFOOBAR",
+			SecretAccessKey: "secret",
+			Token:           "token",
+			Expiration:      time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC),
+		},
+	})
+
+	data, err := apc.marshal("")
+	assert.NoError(t, err)
+	assert.Equal(t, `[foobar]
+aws_access_key_id = AKIAFOOBAR
+aws_secret_access_key = secret
+aws_session_token = token
+`, string(data))
+
+	data, err = apc.marshal("env")
+	assert.NoError(t, err)
+	assert.Equal(t, `AWS_ACCESS_KEY_ID=AKIAFOOBAR
+AWS_SECRET_ACCESS_KEY=secret
+AWS_SESSION_TOKEN=token
+`, string(data))
+
+	data, err = apc.marshal("json")
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"AccessKeyId":"AKIAFOOBAR","SecretAccessKey":"secret","Token":"token","Expiration":"2020-11-01T12:00:00Z"}`, string(data))
+
+	data, err = apc.marshal("credential-process")
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"Version":1,"AccessKeyId":"AKIAFOOBAR","SecretAccessKey":"secret","SessionToken":"token","Expiration":"2020-11-01T12:00:00Z"}`, string(data))
+}
+
+// TestAWSProviderConfigConcurrentRenew tests that the handlers can be called
+// while the credentials are being renewed. It's most useful with -race.
+func TestAWSProviderConfigConcurrentRenew(t *testing.T) {
+	vs := newFakeVaultServer(t)
+	defer vs.Close()
+
+	client, err := vault.NewClient(vault.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apc := &AWSProviderConfig{
+		Path: "aws",
+		Role: "vkcc_aws_bar_foo",
+		IMDS: true,
+	}
+	if _, err := apc.renew(client); err != nil {
+		t.Fatal(err)
+	}
+
+	r := mux.NewRouter()
+	apc.setupEndpoints(r, 0)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			if _, err := apc.renew(client); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for _, path := range []string{"/credentials", "/latest/meta-data/iam/security-credentials/vkcc_aws_bar_foo"} {
+					resp, err := http.Get(ts.URL + path)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					io.Copy(ioutil.Discard, resp.Body)
+					resp.Body.Close()
+					assert.Equal(t, http.StatusOK, resp.StatusCode)
+				}
+				_, err := apc.marshal("")
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestAWSProviderConfigIAMUser tests that the lease of iam user credentials
+// is renewed, rather than creating a new user, until it can't be extended
+func TestAWSProviderConfigIAMUser(t *testing.T) {
+	vs := newFakeVaultServer(t)
+	defer vs.Close()
+
+	client, err := vault.NewClient(vault.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apc := &AWSProviderConfig{
+		Path:           "aws",
+		Role:           "vkcc_aws_bar_foo",
+		CredentialType: AWSCredentialTypeIAMUser,
+	}
+
+	_, err = apc.renew(client)
+	assert.NoError(t, err)
+	state := apc.load()
+	assert.Equal(t, "AKIAUSER1", state.creds.AccessKeyID)
+	assert.Equal(t, "", state.creds.Token)
+	assert.Equal(t, "aws/creds/vkcc_aws_bar_foo/user-1", state.leaseID)
+
+	// The lease is renewed, extending the expiry of the same credentials
+	expiry, err := apc.renew(client)
+	assert.NoError(t, err)
+	assert.Equal(t, "AKIAUSER1", apc.load().creds.AccessKeyID)
+	assert.True(t, expiry.After(time.Now().Add(30*time.Minute)))
+
+	// New credentials are read when renewing the lease doesn't extend it
+	apc.store(&awsState{
+		creds: &AWSCredentials{
+			AccessKeyID:     "AKIAUSER1",
+			SecretAccessKey: "secret",
+			Expiration:      time.Now().Add(2 * time.Hour),
+		},
+		leaseID:   "aws/creds/vkcc_aws_bar_foo/user-1",
+		renewable: true,
+	})
+	_, err = apc.renew(client)
+	assert.NoError(t, err)
+	assert.Equal(t, "AKIAUSER2", apc.load().creds.AccessKeyID)
+
+	// The session token is omitted from the credentials file
+	data, err := apc.marshal("")
+	assert.NoError(t, err)
+	assert.Equal(t, `[default]
+aws_access_key_id = AKIAUSER2
+aws_secret_access_key = secret
+`, string(data))
+}
+
+// TestAWSProviderConfigExpiryMargin tests that credentials aren't served once
+// they're within the expiry margin
+func TestAWSProviderConfigExpiryMargin(t *testing.T) {
+	apc := &AWSProviderConfig{
+		Role: "vkcc_aws_bar_foo",
+		IMDS: true,
+	}
+	apc.store(&awsState{
+		creds: &AWSCredentials{
+			AccessKeyID:     "AKIAFOOBAR",
+			SecretAccessKey: "secret",
+			Token:           "token",
+			Expiration:      time.Now().Add(4 * time.Minute),
+		},
+	})
+
+	r := mux.NewRouter()
+	apc.setupEndpoints(r, 5*time.Minute)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	awsErr := &awsError{}
+	err = json.NewDecoder(resp.Body).Decode(awsErr)
+	resp.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "ServiceUnavailable", awsErr.Code)
+
+	resp, err = http.Get(ts.URL + "/latest/meta-data/iam/security-credentials/vkcc_aws_bar_foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+// TestAWSProviderConfigRoles tests that additional roles are served at
+// /credentials/<name> and as named profiles in the credentials file
+func TestAWSProviderConfigRoles(t *testing.T) {
+	apc := &AWSProviderConfig{
+		Roles: []*AWSRole{
+			{Name: "foo", RoleArn: "arn:aws:iam::111111111111:role/foo"},
+			{Name: "bar", RoleArn: "arn:aws:iam::222222222222:role/bar"},
+		},
+	}
+
+	_, err := apc.marshal("json")
+	assert.True(t, errors.Is(err, errUnsupportedFormat))
+
+	_, err = apc.marshal("")
+	assert.Error(t, err)
+
+	// Test that profiles are only written once they have credentials
+	apc.Roles[0].store(&awsState{
+		creds: &AWSCredentials{
+			AccessKeyID:     "AKIAFOO",
+			SecretAccessKey: "foo-secret",
+			Token:           "foo-token",
+			Expiration:      time.Now().Add(time.Hour),
+		},
+	})
+
+	data, err := apc.marshal("")
+	assert.NoError(t, err)
+	assert.Equal(t, `[foo]
+aws_access_key_id = AKIAFOO
+aws_secret_access_key = foo-secret
+aws_session_token = foo-token
+`, string(data))
+
+	apc.store(&awsState{
+		creds: &AWSCredentials{
+			AccessKeyID:     "AKIAFOOBAR",
+			SecretAccessKey: "secret",
+			Token:           "token",
+			Expiration:      time.Now().Add(time.Hour),
+		},
+	})
+
+	data, err = apc.marshal("")
+	assert.NoError(t, err)
+	assert.Equal(t, `[default]
+aws_access_key_id = AKIAFOOBAR
+aws_secret_access_key = secret
+aws_session_token = token
+
+[foo]
+aws_access_key_id = AKIAFOO
+aws_secret_access_key = foo-secret
+aws_session_token = foo-token
+`, string(data))
+
+	r := mux.NewRouter()
+	apc.setupEndpoints(r, 0)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	for path, want := range map[string]string{
+		"/credentials":         "AKIAFOOBAR",
+		"/credentials/default": "AKIAFOOBAR",
+		"/credentials/foo":     "AKIAFOO",
+	} {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		creds := &AWSCredentials{}
+		err = json.NewDecoder(resp.Body).Decode(creds)
+		resp.Body.Close()
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, path)
+		assert.Equal(t, want, creds.AccessKeyID, path)
+	}
+
+	resp, err := http.Get(ts.URL + "/credentials/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, err = http.Get(ts.URL + "/credentials/baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -74,118 +75,190 @@ type GCPProviderConfig struct {
 	Path    string
 	RoleSet string
 
+	// state holds the current *gcpState. It's replaced, rather than
+	// modified, by renew so that a token is never served alongside the
+	// metadata of a different roleset.
+	state atomic.Value
+}
+
+// gcpState is an immutable snapshot of the credentials and metadata served by
+// the GCP provider
+type gcpState struct {
 	creds    *GCPCredentials
 	metadata *gceMetadata
 }
 
+// load returns the current state. The credentials and metadata in the
+// returned state are nil if they haven't been retrieved yet.
+func (gpc *GCPProviderConfig) load() *gcpState {
+	state, ok := gpc.state.Load().(*gcpState)
+	if !ok {
+		return &gcpState{}
+	}
+
+	return state
+}
+
+// store replaces the current state
+func (gpc *GCPProviderConfig) store(state *gcpState) {
+	gpc.state.Store(state)
+}
+
 // renew retrieves credentials from vault for the secret indicated in
 // the configuration
-func (gpc *GCPProviderConfig) renew(client *vault.Client) (time.Duration, error) {
+func (gpc *GCPProviderConfig) renew(client *vault.Client) (time.Time, error) {
 	// Get a credentials secret from vault for the role
 	secret, err := client.Logical().Read(gpc.Path + "/token/" + gpc.RoleSet)
 	if err != nil {
-		return -1, err
-	}
-
-	// Convert the secret's TTL into a time.Duration
-	tokenTTL, err := (secret.Data["token_ttl"].(json.Number)).Int64()
-	if err != nil {
-		return -1, err
+		return time.Time{}, err
 	}
-	leaseDuration := time.Duration(tokenTTL) * time.Second
 
 	// Calculate expiry time
 	expiresAtSeconds, err := (secret.Data["expires_at_seconds"].(json.Number)).Int64()
 	if err != nil {
-		return -1, err
+		return time.Time{}, err
 	}
 
-	if err := gpc.updateMetadata(client); err != nil {
-		return -1, err
+	metadata, err := gpc.readMetadata(client)
+	if err != nil {
+		return time.Time{}, err
 	}
 
 	expiresAt := time.Unix(expiresAtSeconds, 0)
 
 	log.Info("new gcp credentials",
 		"expiration", expiresAt.Format("2006-01-02 15:04:05"),
-		"project", gpc.metadata.project,
-		"service_account_email", gpc.metadata.email,
-		"scopes", gpc.metadata.scopes,
+		"project", metadata.project,
+		"service_account_email", metadata.email,
+		"scopes", metadata.scopes,
 	)
 
-	gpc.creds = &GCPCredentials{
-		AccessToken: secret.Data["token"].(string),
-		TokenType:   "Bearer",
-		expiresAt:   expiresAt,
-	}
+	gpc.store(&gcpState{
+		creds: &GCPCredentials{
+			AccessToken: secret.Data["token"].(string),
+			TokenType:   "Bearer",
+			expiresAt:   expiresAt,
+		},
+		metadata: metadata,
+	})
 
-	return leaseDuration, nil
+	return expiresAt, nil
 }
 
-// updateMetadata extracts metadata from the roleset in vault
-func (gpc *GCPProviderConfig) updateMetadata(client *vault.Client) error {
+// readMetadata extracts metadata from the roleset in vault
+func (gpc *GCPProviderConfig) readMetadata(client *vault.Client) (*gceMetadata, error) {
 	roleset, err := client.Logical().Read(gpc.Path + "/roleset/" + gpc.RoleSet)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var scopes []string
 	tokenScopes, ok := roleset.Data["token_scopes"].([]interface{})
 	if !ok {
-		return fmt.Errorf("token_scopes is not a []interface{}")
+		return nil, fmt.Errorf("token_scopes is not a []interface{}")
 	}
 	for _, ts := range tokenScopes {
 		scope, ok := ts.(string)
 		if !ok {
-			return fmt.Errorf("scope is not a string")
+			return nil, fmt.Errorf("scope is not a string")
 		}
 		scopes = append(scopes, scope)
 	}
 
 	project, ok := roleset.Data["project"].(string)
 	if !ok {
-		return fmt.Errorf("project is not a string")
+		return nil, fmt.Errorf("project is not a string")
 	}
 
 	email, ok := roleset.Data["service_account_email"].(string)
 	if !ok {
-		return fmt.Errorf("service_account_email is not a string")
+		return nil, fmt.Errorf("service_account_email is not a string")
 	}
 
-	gpc.metadata = &gceMetadata{
+	return &gceMetadata{
 		email:   email,
 		project: project,
 		scopes:  scopes,
+	}, nil
+}
+
+// marshal returns the credentials in one of these formats:
+//   - token (default): the access token
+//   - json: the format served by the token endpoint
+func (gpc *GCPProviderConfig) marshal(format string) ([]byte, error) {
+	switch format {
+	case "", "token", "json":
+	default:
+		return nil, fmt.Errorf("%w for gcp: %s", errUnsupportedFormat, format)
+	}
+
+	creds := gpc.load().creds
+	if creds == nil {
+		return nil, fmt.Errorf("credentials not initialized")
+	}
+
+	if format == "json" {
+		return json.Marshal(creds)
 	}
 
+	return []byte(creds.AccessToken), nil
+}
+
+// renewers returns the provider itself, as it serves a single token
+func (gpc *GCPProviderConfig) renewers() []renewer {
+	return []renewer{gpc}
+}
+
+// name returns the name of the token in logs and metrics
+func (gpc *GCPProviderConfig) name() string {
+	return "default"
+}
+
+// revoke is a no-op, because access tokens aren't leased by vault
+func (gpc *GCPProviderConfig) revoke(client *vault.Client) error {
 	return nil
 }
 
+// env points the GCP client libraries at the metadata endpoints
+func (gpc *GCPProviderConfig) env(address string) []string {
+	return []string{
+		"GCE_METADATA_HOST=" + address,
+		"GCE_METADATA_IP=" + address,
+	}
+}
+
 // setupEndpoints adds the endpoints required to masquerade
 // as the GCE metdata service
-func (gpc *GCPProviderConfig) setupEndpoints(r *mux.Router) {
+func (gpc *GCPProviderConfig) setupEndpoints(r *mux.Router, margin time.Duration) {
 	r.HandleFunc("/computeMetadata/v1/instance/service-accounts/{service_account}/token", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		if gpc.creds == nil {
+		creds := gpc.load().creds
+		if creds == nil {
 			httpError(w, "Credentials not initialized", http.StatusNotFound, &gcpError{})
 			return
 		}
-		if err := json.NewEncoder(w).Encode(gpc.creds); err != nil {
+		if expiresWithin(creds.expiresAt, margin) {
+			httpError(w, "Credentials have expired", http.StatusServiceUnavailable, &gcpError{})
+			return
+		}
+		if err := json.NewEncoder(w).Encode(creds); err != nil {
 			httpError(w, "Error encoding credentials response as json", http.StatusInternalServerError, &gcpError{})
 			return
 		}
 	})
 	r.HandleFunc("/computeMetadata/v1/project/project-id", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/text")
-		if gpc.metadata == nil {
+		metadata := gpc.load().metadata
+		if metadata == nil {
 			http.Error(w, "Metadata not initialized", http.StatusNotFound)
 			return
 		}
-		w.Write([]byte(gpc.metadata.project))
+		w.Write([]byte(metadata.project))
 	})
 	r.HandleFunc("/computeMetadata/v1/project/numeric-project-id", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/text")
-		if gpc.metadata == nil {
+		metadata := gpc.load().metadata
+		if metadata == nil {
 			http.Error(w, "Metadata not initialized", http.StatusNotFound)
 			return
 		}
@@ -199,17 +272,18 @@ func (gpc *GCPProviderConfig) setupEndpoints(r *mux.Router) {
 			http.Error(w, "Can't parse query arguments", http.StatusInternalServerError)
 			return
 		}
+		metadata := gpc.load().metadata
 		if v := r.Form["recursive"]; len(v) != 1 || v[0] != "true" {
 			w.Header().Set("Content-Type", "application/text")
-			if gpc.metadata == nil {
+			if metadata == nil {
 				http.Error(w, "Metadata not initialized", http.StatusNotFound)
 				return
 			}
-			w.Write([]byte("default/\n" + gpc.metadata.email + "/\n"))
+			w.Write([]byte("default/\n" + metadata.email + "/\n"))
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
-		if gpc.metadata == nil {
+		if metadata == nil {
 			httpError(w, "Metadata not initialized", http.StatusNotFound, &gcpError{})
 			return
 		}
@@ -218,15 +292,15 @@ func (gpc *GCPProviderConfig) setupEndpoints(r *mux.Router) {
 				Aliases: []string{
 					"default",
 				},
-				Email:  gpc.metadata.email,
-				Scopes: gpc.metadata.scopes,
+				Email:  metadata.email,
+				Scopes: metadata.scopes,
 			},
-			gpc.metadata.email: &gceServiceAccountDetails{
+			metadata.email: &gceServiceAccountDetails{
 				Aliases: []string{
 					"default",
 				},
-				Email:  gpc.metadata.email,
-				Scopes: gpc.metadata.scopes,
+				Email:  metadata.email,
+				Scopes: metadata.scopes,
 			},
 		}); err != nil {
 			httpError(w, "Error encoding service accounts request as json", http.StatusNotFound, &gcpError{})
@@ -244,7 +318,8 @@ func (gpc *GCPProviderConfig) setupEndpoints(r *mux.Router) {
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
-		if gpc.metadata == nil {
+		metadata := gpc.load().metadata
+		if metadata == nil {
 			httpError(w, "Metadata not initialized", http.StatusNotFound, &gcpError{})
 			return
 		}
@@ -252,8 +327,8 @@ func (gpc *GCPProviderConfig) setupEndpoints(r *mux.Router) {
 			Aliases: []string{
 				"default",
 			},
-			Email:  gpc.metadata.email,
-			Scopes: gpc.metadata.scopes,
+			Email:  metadata.email,
+			Scopes: metadata.scopes,
 		}); err != nil {
 			httpError(w, "Error encoding service account request as json", http.StatusNotFound, &gcpError{})
 			return
@@ -265,19 +340,21 @@ func (gpc *GCPProviderConfig) setupEndpoints(r *mux.Router) {
 	})
 	r.HandleFunc("/computeMetadata/v1/instance/service-accounts/{service_account}/email", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/text")
-		if gpc.metadata == nil {
+		metadata := gpc.load().metadata
+		if metadata == nil {
 			http.Error(w, "Metadata not initialized", http.StatusNotFound)
 			return
 		}
-		w.Write([]byte(gpc.metadata.email))
+		w.Write([]byte(metadata.email))
 	})
 	r.HandleFunc("/computeMetadata/v1/instance/service-accounts/{service_account}/scopes", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/text")
-		if gpc.metadata == nil {
+		metadata := gpc.load().metadata
+		if metadata == nil {
 			http.Error(w, "Metadata not initialized", http.StatusNotFound)
 			return
 		}
-		w.Write([]byte(strings.Join(gpc.metadata.scopes, "\n")))
+		w.Write([]byte(strings.Join(metadata.scopes, "\n")))
 	})
 	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path != "/" {
@@ -0,0 +1,136 @@
+package sidecar
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	vault "github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestGCPProviderConfigConcurrentRenew tests that the handlers can be called
+// while the credentials are being renewed and that a token is always paired
+// with the metadata retrieved in the same renewal. It's most useful with
+// -race.
+func TestGCPProviderConfigConcurrentRenew(t *testing.T) {
+	vs := newFakeVaultServer(t)
+	defer vs.Close()
+
+	client, err := vault.NewClient(vault.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gpc := &GCPProviderConfig{
+		Path:    "gcp",
+		RoleSet: "vkcc_gcp_bar_foo",
+	}
+	if _, err := gpc.renew(client); err != nil {
+		t.Fatal(err)
+	}
+
+	r := mux.NewRouter()
+	gpc.setupEndpoints(r, 0)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			if _, err := gpc.renew(client); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				state := gpc.load()
+				assert.True(t, strings.HasPrefix(state.metadata.email, state.creds.AccessToken+"@"), "token %s served with metadata for %s", state.creds.AccessToken, state.metadata.email)
+
+				resp, err := http.Get(ts.URL + "/computeMetadata/v1/instance/service-accounts/default/token")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				creds := &GCPCredentials{}
+				err = json.NewDecoder(resp.Body).Decode(creds)
+				resp.Body.Close()
+				assert.NoError(t, err)
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				assert.NotEmpty(t, creds.AccessToken)
+
+				resp, err = http.Get(ts.URL + "/computeMetadata/v1/instance/service-accounts/default/?recursive=true")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestGCPProviderConfigExpiryMargin tests that the token isn't served once
+// it's within the expiry margin
+func TestGCPProviderConfigExpiryMargin(t *testing.T) {
+	gpc := &GCPProviderConfig{}
+	gpc.store(&gcpState{
+		creds: &GCPCredentials{
+			AccessToken: "token",
+			TokenType:   "Bearer",
+			expiresAt:   time.Now().Add(4 * time.Minute),
+		},
+		metadata: &gceMetadata{
+			email:   "foobar@foobar.iam.gserviceaccount.com",
+			project: "foobar",
+		},
+	})
+
+	r := mux.NewRouter()
+	gpc.setupEndpoints(r, 5*time.Minute)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/computeMetadata/v1/instance/service-accounts/default/token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcpErr := &gcpError{}
+	err = json.NewDecoder(resp.Body).Decode(gcpErr)
+	resp.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "service_unavailable", gcpErr.Error)
+
+	// Test that the metadata is still served
+	resp, err = http.Get(ts.URL + "/computeMetadata/v1/project/project-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
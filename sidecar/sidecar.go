@@ -1,12 +1,17 @@
 package sidecar
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -20,21 +25,47 @@ var (
 	log = ctrl.Log.WithName("sidecar")
 )
 
+// tokenExpiryMargin is how long before the vault token expires that the
+// sidecar logs in again, rather than renewing it
+const tokenExpiryMargin = time.Minute
+
 // Config configures the sidecar
 type Config struct {
 	ProviderConfig ProviderConfig
-	KubeAuthPath   string
-	KubeAuthRole   string
-	ListenAddress  string
-	OpsAddress     string
-	TokenPath      string
+	// CredentialsFile, when set, is rewritten with the credentials after
+	// every renewal
+	CredentialsFile string
+	// CredentialsFormat is the format of the credentials written to the
+	// credentials file, or to stdout by RunOnce. Empty selects the
+	// default format for the provider.
+	CredentialsFormat string
+	// ExpiryMargin is how long before they expire that the credentials
+	// stop being served. They are renewed before they reach the margin.
+	ExpiryMargin time.Duration
+	KubeAuthPath string
+	KubeAuthRole string
+	// ListenAddress is the address that the provider endpoints are served
+	// on. They aren't served if it's empty.
+	ListenAddress string
+	OpsAddress    string
+	// RevokeOnShutdown revokes the credentials lease and the vault token
+	// when the sidecar shuts down
+	RevokeOnShutdown bool
+	// ShutdownTimeout is how long to wait for in-flight requests and
+	// revocation when shutting down
+	ShutdownTimeout time.Duration
+	TokenPath       string
 }
 
 // Sidecar provides the basic functionality for retrieving credentials using the
 // provided ProviderConfig
 type Sidecar struct {
 	*Config
-	backoff        *Backoff
+	renewals       []*renewal
+	authMu         sync.Mutex
+	fileMu         sync.Mutex
+	tokenExpiry    time.Time
+	tokenRenewable bool
 	vaultClient    *vault.Client
 	vaultConfig    *vault.Config
 	vaultTLSConfig *tls.Config
@@ -42,6 +73,10 @@ type Sidecar struct {
 
 // New returns a sidecar with the provided config
 func New(config *Config) (*Sidecar, error) {
+	if _, err := config.ProviderConfig.marshal(config.CredentialsFormat); errors.Is(err, errUnsupportedFormat) {
+		return nil, err
+	}
+
 	vaultConfig := vault.DefaultConfig()
 
 	// Capture the TLS config of the Transport before it's wrapped and
@@ -59,15 +94,22 @@ func New(config *Config) (*Sidecar, error) {
 		return nil, err
 	}
 
-	backoff := &Backoff{
-		Jitter: true,
-		Min:    2 * time.Second,
-		Max:    1 * time.Minute,
+	var renewals []*renewal
+	for _, r := range config.ProviderConfig.renewers() {
+		renewals = append(renewals, &renewal{
+			renewer: r,
+			backoff: &Backoff{
+				Jitter: true,
+				Min:    2 * time.Second,
+				Max:    1 * time.Minute,
+			},
+			status: &renewalStatus{margin: config.ExpiryMargin},
+		})
 	}
 
 	return &Sidecar{
 		Config:         config,
-		backoff:        backoff,
+		renewals:       renewals,
 		vaultConfig:    vaultConfig,
 		vaultClient:    vaultClient,
 		vaultTLSConfig: vaultTLSConfig,
@@ -75,57 +117,241 @@ func New(config *Config) (*Sidecar, error) {
 }
 
 // Run starts the sidecar. It retrieves credentials from vault and serves them
-// for the configured cloud provider
+// for the configured cloud provider until it receives SIGINT or SIGTERM
 func (s *Sidecar) Run() error {
 	// Random is used for the backoff and the interval between renewal
 	// attempts
 	rand.Seed(int64(time.Now().Nanosecond()))
 
-	ready := make(chan bool, 1)
+	stop := make(chan struct{})
+	ready, done := s.startRenewals(stop)
+
+	errors := make(chan error, 2)
+
+	// Serve operational endpoints
+	opsServer := &http.Server{Addr: s.OpsAddress, Handler: s.opsHandler()}
+	go func() {
+		log.Info("operational status server is listening", "address", s.OpsAddress)
+		errors <- opsServer.ListenAndServe()
+	}()
+
+	// Serve provider endpoints
+	var providerServer *http.Server
+	if s.ListenAddress != "" {
+		providerServer = &http.Server{Addr: s.ListenAddress, Handler: s.providerHandler()}
+		go func() {
+			// Block until the provider has retrieved the first set of
+			// credentials
+			<-ready
+			log.Info("webserver is listening", "address", s.ListenAddress)
+			errors <- providerServer.ListenAndServe()
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case err := <-errors:
+		return err
+	case sig := <-signals:
+		log.Info("shutting down", "signal", sig.String())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout())
+	defer cancel()
+
+	// Stop accepting requests and wait for the in-flight ones to finish
+	if providerServer != nil {
+		if err := providerServer.Shutdown(ctx); err != nil {
+			log.Error(err, "error shutting down webserver")
+		}
+	}
+
+	close(stop)
+	s.revoke(ctx, done)
+
+	if err := opsServer.Shutdown(ctx); err != nil {
+		log.Error(err, "error shutting down operational status server")
+	}
+
+	return nil
+}
+
+// renewal is a set of credentials served by the provider, which is renewed
+// by its own loop
+type renewal struct {
+	renewer renewer
+	backoff *Backoff
+	status  *renewalStatus
+}
+
+// startRenewals starts a renewal loop for each set of credentials. The
+// returned ready channel is closed once they have all been retrieved for the
+// first time and done is closed once all the loops have returned, after stop
+// is closed.
+func (s *Sidecar) startRenewals(stop <-chan struct{}) (<-chan struct{}, <-chan struct{}) {
+	renewed := make(chan bool, len(s.renewals))
+	ready := make(chan struct{})
+	done := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for _, r := range s.renewals {
+		wg.Add(1)
+		go func(r *renewal) {
+			defer wg.Done()
+			s.renewLoop(r, renewed, stop)
+		}(r)
+	}
 
 	go func() {
-		firstRun := true
-		for {
-			duration, err := s.renew()
-			if err != nil {
+		wg.Wait()
+		close(done)
+	}()
+
+	go func() {
+		for range s.renewals {
+			select {
+			case <-renewed:
+			case <-stop:
+				return
+			}
+		}
+		close(ready)
+	}()
+
+	return ready, done
+}
+
+// renewLoop renews the credentials until stop is closed, sleeping between
+// successful renewals and backing off after failures. It sends on ready
+// after the first successful renewal.
+func (s *Sidecar) renewLoop(r *renewal, ready chan<- bool, stop <-chan struct{}) {
+	name := r.renewer.name()
+	firstRun := true
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		expiry, err := s.renew(r.renewer)
+		if err != nil {
+			promErrors.Inc()
+			d := r.backoff.Duration()
+			r.status.failed(err, time.Now().Add(d))
+			log.Error(err, "error renewing credentials", "name", name, "backoff", d)
+			if !sleep(d, stop) {
+				return
+			}
+			continue
+		}
+
+		// Credentials that are already within the margin won't be
+		// served, so try again
+		if expiresWithin(expiry, s.ExpiryMargin) {
+			promErrors.Inc()
+			d := r.backoff.Duration()
+			err := fmt.Errorf("new credentials expire at %s, within the expiry margin of %s", expiry.Format(time.RFC3339), s.ExpiryMargin)
+			r.status.failed(err, time.Now().Add(d))
+			log.Error(err, "error renewing credentials", "name", name, "backoff", d)
+			if !sleep(d, stop) {
+				return
+			}
+			continue
+		}
+
+		if s.CredentialsFile != "" {
+			if err := s.writeCredentialsFile(); err != nil {
 				promErrors.Inc()
-				d := s.backoff.Duration()
-				log.Error(err, "error renewing credentials", "backoff", d)
-				time.Sleep(d)
+				d := r.backoff.Duration()
+				r.status.failed(err, time.Now().Add(d))
+				log.Error(err, "error writing credentials file", "name", name, "file", s.CredentialsFile, "backoff", d)
+				if !sleep(d, stop) {
+					return
+				}
 				continue
 			}
-			s.backoff.Reset()
+		}
 
-			promRenewals.Inc()
-			promExpiry.Set(float64(time.Now().Add(duration).Unix()))
+		r.backoff.Reset()
 
-			if firstRun {
-				ready <- true
-				firstRun = false
-			}
+		promRenewals.Inc()
+		promExpiry.WithLabelValues(name).Set(float64(expiry.Unix()))
 
-			// Sleep until its time to renew the creds
-			time.Sleep(sleepDuration(duration))
+		if firstRun {
+			ready <- true
+			firstRun = false
 		}
-	}()
 
-	errors := make(chan error)
+		// Sleep until its time to renew the creds
+		d := sleepDuration(time.Until(expiry) - s.ExpiryMargin)
+		r.status.succeeded(expiry, time.Now().Add(d))
+		if !sleep(d, stop) {
+			return
+		}
+	}
+}
 
-	// Serve operational endpoints
+// revoke waits for the renewal loops to finish and then revokes the
+// credentials leases and the vault token, if RevokeOnShutdown is set
+func (s *Sidecar) revoke(ctx context.Context, done <-chan struct{}) {
+	if !s.RevokeOnShutdown {
+		return
+	}
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Error(ctx.Err(), "timed out waiting for renewal to finish, skipping revocation")
+		return
+	}
+
+	for _, r := range s.renewals {
+		if err := r.renewer.revoke(s.vaultClient); err != nil {
+			log.Error(err, "error revoking credentials lease", "name", r.renewer.name())
+		}
+	}
+
+	if s.vaultClient.Token() == "" {
+		return
+	}
+	if err := s.vaultClient.Auth().Token().RevokeSelf(""); err != nil {
+		log.Error(err, "error revoking vault token")
+		return
+	}
+	s.vaultClient.ClearToken()
+	s.tokenExpiry = time.Time{}
+	s.tokenRenewable = false
+	log.Info("revoked vault token")
+}
+
+// shutdownTimeout returns the configured shutdown timeout, or a default
+func (s *Sidecar) shutdownTimeout() time.Duration {
+	if s.ShutdownTimeout > 0 {
+		return s.ShutdownTimeout
+	}
+
+	return 10 * time.Second
+}
+
+// opsHandler returns a handler that serves the operational endpoints
+func (s *Sidecar) opsHandler() http.Handler {
 	sr := mux.NewRouter()
-	sr.PathPrefix("/__/").Handler(statusHandler)
+	sr.PathPrefix("/__/").Handler(newStatusHandler(s.renewals))
 
-	go func() {
-		log.Info("operational status server is listening", "address", s.OpsAddress)
-		errors <- http.ListenAndServe(s.OpsAddress, sr)
-	}()
+	return sr
+}
 
-	// Serve provider endpoints
+// providerHandler returns a handler that serves the provider endpoints,
+// instrumented with logging and metrics
+func (s *Sidecar) providerHandler() http.Handler {
 	r := mux.NewRouter()
-	s.ProviderConfig.setupEndpoints(r)
+	s.ProviderConfig.setupEndpoints(r, s.ExpiryMargin)
 
-	// Instrument the handler with logging and metrics
-	ir := instrumentHandlerLogging(
+	return instrumentHandlerLogging(
 		promhttp.InstrumentHandlerInFlight(promRequestsInFlight,
 			promhttp.InstrumentHandlerDuration(promRequestsDuration,
 				promhttp.InstrumentHandlerCounter(promRequests,
@@ -136,31 +362,70 @@ func (s *Sidecar) Run() error {
 			),
 		),
 	)
+}
 
-	go func() {
-		// Block until the provider has retrieved the first set of
-		// credentials
-		<-ready
-		log.Info("webserver is listening", "address", s.ListenAddress)
-		errors <- http.ListenAndServe(s.ListenAddress, ir)
-	}()
+// renew the credentials, returning the time they expire
+func (s *Sidecar) renew(r renewer) (time.Time, error) {
+	if err := s.authenticate(); err != nil {
+		return time.Time{}, err
+	}
+
+	// Renew credentials for the provider
+	return r.renew(s.vaultClient)
+}
+
+// authenticate ensures that the vault client has a valid token. The current
+// token is renewed while it's renewable, falling back to logging in again
+// when it's about to expire or can't be renewed.
+func (s *Sidecar) authenticate() error {
+	s.authMu.Lock()
+	defer s.authMu.Unlock()
 
-	err := <-errors
+	if s.vaultClient.Token() == "" || !s.tokenRenewable || expiresWithin(s.tokenExpiry, tokenExpiryMargin) {
+		return s.login()
+	}
+
+	if err := s.renewToken(); err != nil {
+		log.Error(err, "error renewing vault token, logging in again")
+		return s.login()
+	}
+
+	return nil
+}
+
+// renewToken renews the current vault token
+func (s *Sidecar) renewToken() error {
+	secret, err := s.vaultClient.Auth().Token().RenewSelf(0)
+	if err != nil {
+		return err
+	}
+	if secret == nil || secret.Auth == nil {
+		return fmt.Errorf("no authentication information attached to the response from auth/token/renew-self")
+	}
+	s.setTokenLease(secret.Auth)
+	promTokenRenewals.Inc()
 
-	return err
+	return nil
 }
 
-// renew the credentials
-func (s *Sidecar) renew() (time.Duration, error) {
+// setTokenLease records when the current vault token expires and whether it
+// can be renewed
+func (s *Sidecar) setTokenLease(auth *vault.SecretAuth) {
+	s.tokenExpiry = time.Now().Add(time.Duration(auth.LeaseDuration) * time.Second)
+	s.tokenRenewable = auth.Renewable
+}
+
+// login to vault with the kubernetes service account token
+func (s *Sidecar) login() error {
 	// Reload vault CA from the environment
 	if err := s.reloadVaultCA(); err != nil {
-		return -1, err
+		return err
 	}
 
 	// Login to Vault via kube SA
 	jwt, err := ioutil.ReadFile(s.TokenPath)
 	if err != nil {
-		return -1, err
+		return err
 	}
 	loginPath := "auth/" + s.KubeAuthPath + "/login"
 	secret, err := s.vaultClient.Logical().Write(loginPath, map[string]interface{}{
@@ -168,18 +433,39 @@ func (s *Sidecar) renew() (time.Duration, error) {
 		"role": s.KubeAuthRole,
 	})
 	if err != nil {
-		return -1, err
+		return err
 	}
 	if secret == nil {
-		return -1, fmt.Errorf("no secret returned by %s", loginPath)
+		return fmt.Errorf("no secret returned by %s", loginPath)
 	}
 	if secret.Auth == nil {
-		return -1, fmt.Errorf("no authentication information attached to the response from %s", loginPath)
+		return fmt.Errorf("no authentication information attached to the response from %s", loginPath)
 	}
 	s.vaultClient.SetToken(secret.Auth.ClientToken)
+	s.setTokenLease(secret.Auth)
+	promLogins.Inc()
 
-	// Renew credentials for the provider
-	return s.ProviderConfig.renew(s.vaultClient)
+	return nil
+}
+
+// writeCredentialsFile atomically replaces the credentials file with the
+// current credentials. The file is readable by its owner and group, so that
+// the application can read it through the fsGroup of the pod.
+func (s *Sidecar) writeCredentialsFile() error {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+
+	data, err := s.ProviderConfig.marshal(s.CredentialsFormat)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(s.CredentialsFile, data, 0640); err != nil {
+		return err
+	}
+	log.Info("wrote credentials file", "file", s.CredentialsFile)
+
+	return nil
 }
 
 // reloadVaultCA updates the tls.Config used by the vault client with the CA
@@ -236,8 +522,22 @@ func instrumentHandlerLogging(next http.Handler) http.Handler {
 	)
 }
 
-// Sleep for 1/3 of the lease duration with a random jitter to discourage synchronised API calls from
-// multiple instances of the application
-func sleepDuration(leaseDuration time.Duration) time.Duration {
-	return time.Duration((float64(leaseDuration.Nanoseconds()) * 1 / 3) * (rand.Float64() + 1.50) / 2)
+// sleep for the duration, returning early with false if stop is closed
+func sleep(d time.Duration, stop <-chan struct{}) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-stop:
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// Sleep for 1/3 of the time remaining before the credentials expire (or
+// enter the expiry margin) with a random jitter to discourage synchronised API
+// calls from multiple instances of the application
+func sleepDuration(remaining time.Duration) time.Duration {
+	return time.Duration((float64(remaining.Nanoseconds()) * 1 / 3) * (rand.Float64() + 1.50) / 2)
 }
@@ -0,0 +1,349 @@
+package sidecar
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newFakeVaultServer returns a server that implements the subset of the vault
+// API used by the sidecar to login and retrieve AWS and GCP credentials.
+// Every read of AWS iam user credentials creates a new access key.
+// VAULT_ADDR is pointed at the server. Each GCP token is paired with a
+// service account email that contains it, so that tests can detect a token
+// served with the metadata from a different renewal.
+func newFakeVaultServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/auth/kubernetes/login", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"auth": map[string]interface{}{
+				"client_token":   "s.foobar",
+				"lease_duration": 900,
+				"renewable":      true,
+			},
+		})
+	})
+	mux.HandleFunc("/v1/auth/token/renew-self", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"auth": map[string]interface{}{
+				"client_token":   "s.foobar",
+				"lease_duration": 900,
+				"renewable":      true,
+			},
+		})
+	})
+	mux.HandleFunc("/v1/aws/sts/", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"lease_id":       "aws/sts/" + strings.TrimPrefix(r.URL.Path, "/v1/aws/sts/") + "/foobar",
+			"lease_duration": 900,
+			"renewable":      false,
+			"data": map[string]interface{}{
+				"access_key":     "AKIAFOOBAR",
+				"secret_key":     "secret",
+				"security_token": "token",
+			},
+		})
+	})
+	var iamUsers int64
+	mux.HandleFunc("/v1/aws/creds/", func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&iamUsers, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"lease_id":       fmt.Sprintf("aws/creds/%s/user-%d", strings.TrimPrefix(r.URL.Path, "/v1/aws/creds/"), n),
+			"lease_duration": 900,
+			"renewable":      true,
+			"data": map[string]interface{}{
+				"access_key":     fmt.Sprintf("AKIAUSER%d", n),
+				"secret_key":     "secret",
+				"security_token": nil,
+			},
+		})
+	})
+	var gcpTokens, gcpRolesets int64
+	mux.HandleFunc("/v1/gcp/token/", func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&gcpTokens, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{
+				"token":              fmt.Sprintf("token-%d", n),
+				"token_ttl":          3600,
+				"expires_at_seconds": time.Now().Add(time.Hour).Unix(),
+			},
+		})
+	})
+	mux.HandleFunc("/v1/gcp/roleset/", func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&gcpRolesets, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{
+				"project":               "foobar",
+				"service_account_email": fmt.Sprintf("token-%d@foobar.iam.gserviceaccount.com", n),
+				"token_scopes":          []string{"https://www.googleapis.com/auth/cloud-platform"},
+			},
+		})
+	})
+	mux.HandleFunc("/v1/sys/leases/renew", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			LeaseID string `json:"lease_id"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"lease_id":       body.LeaseID,
+			"lease_duration": 3600,
+			"renewable":      true,
+		})
+	})
+	mux.HandleFunc("/v1/sys/leases/lookup", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{
+				"expire_time": time.Now().Add(900 * time.Second).Format(time.RFC3339Nano),
+			},
+		})
+	})
+
+	ts := httptest.NewServer(mux)
+
+	os.Setenv("VAULT_ADDR", ts.URL)
+
+	return ts
+}
+
+// newFakeTokenFile writes a service account token to a temporary file
+func newFakeTokenFile(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "sidecar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokenPath := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenPath, []byte("foobar"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return tokenPath
+}
+
+// TestSidecarWriteCredentialsFile tests that the credentials file is written
+// in the configured format and is only readable by its owner
+func TestSidecarWriteCredentialsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidecar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	apc := &AWSProviderConfig{}
+	apc.store(&awsState{
+		creds: &AWSCredentials{
+			AccessKeyID:     "AKIAFOOBAR",
+			SecretAccessKey: "secret",
+		},
+	})
+
+	s := &Sidecar{
+		Config: &Config{
+			CredentialsFile:   filepath.Join(dir, "credentials"),
+			CredentialsFormat: "env",
+			ProviderConfig:    apc,
+		},
+	}
+	if !assert.NoError(t, s.writeCredentialsFile()) {
+		return
+	}
+
+	data, err := ioutil.ReadFile(s.CredentialsFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "AWS_ACCESS_KEY_ID=AKIAFOOBAR\nAWS_SECRET_ACCESS_KEY=secret\n", string(data))
+
+	info, err := os.Stat(s.CredentialsFile)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	}
+}
+
+// TestSidecarExec tests that the child process is given the environment for
+// the provider and that its exit code is returned
+func TestSidecarExec(t *testing.T) {
+	ts := newFakeVaultServer(t)
+	defer ts.Close()
+
+	tokenPath := newFakeTokenFile(t)
+	defer os.RemoveAll(filepath.Dir(tokenPath))
+
+	s, err := New(&Config{
+		KubeAuthPath: "kubernetes",
+		KubeAuthRole: "vkcc_aws_bar_foo",
+		ProviderConfig: &AWSProviderConfig{
+			Path:               "aws",
+			Role:               "vkcc_aws_bar_foo",
+			AuthorizationToken: "foobar",
+		},
+		TokenPath: tokenPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, err := s.Exec(context.Background(), "sh", []string{"-c", `case "$AWS_CONTAINER_CREDENTIALS_FULL_URI" in http://127.0.0.1:*/credentials) [ "$AWS_CONTAINER_AUTHORIZATION_TOKEN" = foobar ] && exit 3;; esac; exit 1`})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, code)
+}
+
+// TestSidecarExecRevoke tests that the credentials lease and the vault token
+// are revoked once the child process has exited
+func TestSidecarExecRevoke(t *testing.T) {
+	ts := newFakeVaultServer(t)
+	defer ts.Close()
+
+	var revoked []string
+	rs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/v1/sys/leases/revoke/") || r.URL.Path == "/v1/auth/token/revoke-self" {
+			revoked = append(revoked, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		ts.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer rs.Close()
+	os.Setenv("VAULT_ADDR", rs.URL)
+
+	tokenPath := newFakeTokenFile(t)
+	defer os.RemoveAll(filepath.Dir(tokenPath))
+
+	s, err := New(&Config{
+		KubeAuthPath: "kubernetes",
+		KubeAuthRole: "vkcc_aws_bar_foo",
+		ProviderConfig: &AWSProviderConfig{
+			Path:               "aws",
+			Role:               "vkcc_aws_bar_foo",
+			AuthorizationToken: "foobar",
+		},
+		RevokeOnShutdown: true,
+		TokenPath:        tokenPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, err := s.Exec(context.Background(), "true", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, []string{
+		"/v1/sys/leases/revoke/aws/sts/vkcc_aws_bar_foo/foobar",
+		"/v1/auth/token/revoke-self",
+	}, revoked)
+}
+
+// TestSidecarExecNotReady tests that the child isn't started, and that Exec
+// returns, when the first set of credentials can't be retrieved
+func TestSidecarExecNotReady(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+	os.Setenv("VAULT_ADDR", ts.URL)
+
+	tokenPath := newFakeTokenFile(t)
+	defer os.RemoveAll(filepath.Dir(tokenPath))
+
+	dir := filepath.Dir(tokenPath)
+	marker := filepath.Join(dir, "started")
+
+	s, err := New(&Config{
+		KubeAuthPath: "kubernetes",
+		KubeAuthRole: "vkcc_aws_bar_foo",
+		ProviderConfig: &AWSProviderConfig{
+			Path:               "aws",
+			Role:               "vkcc_aws_bar_foo",
+			AuthorizationToken: "foobar",
+		},
+		TokenPath: tokenPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The context bounds the wait for the credentials
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	code, err := s.Exec(ctx, "touch", []string{marker})
+	assert.Error(t, err)
+	assert.Equal(t, 1, code)
+	_, err = os.Stat(marker)
+	assert.True(t, os.IsNotExist(err))
+
+	// The operational endpoints failing to serve also stops the wait
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	s.OpsAddress = l.Addr().String()
+
+	code, err = s.Exec(context.Background(), "touch", []string{marker})
+	assert.Error(t, err)
+	assert.Equal(t, 1, code)
+	_, err = os.Stat(marker)
+	assert.True(t, os.IsNotExist(err))
+}
+
+// TestSidecarRenewToken tests that the vault token is renewed between
+// renewals of the credentials, rather than logging in every time
+func TestSidecarRenewToken(t *testing.T) {
+	ts := newFakeVaultServer(t)
+	defer ts.Close()
+
+	var logins, tokenRenewals int
+	rs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/auth/kubernetes/login":
+			logins++
+		case "/v1/auth/token/renew-self":
+			tokenRenewals++
+		}
+		ts.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer rs.Close()
+	os.Setenv("VAULT_ADDR", rs.URL)
+
+	tokenPath := newFakeTokenFile(t)
+	defer os.RemoveAll(filepath.Dir(tokenPath))
+
+	s, err := New(&Config{
+		KubeAuthPath: "kubernetes",
+		KubeAuthRole: "vkcc_aws_bar_foo",
+		ProviderConfig: &AWSProviderConfig{
+			Path: "aws",
+			Role: "vkcc_aws_bar_foo",
+		},
+		TokenPath: tokenPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err := s.renew(s.ProviderConfig.renewers()[0])
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 1, logins)
+	assert.Equal(t, 2, tokenRenewals)
+
+	// Test that the sidecar logs in again when the token is about to
+	// expire
+	s.tokenExpiry = time.Now().Add(30 * time.Second)
+	_, err = s.renew(s.ProviderConfig.renewers()[0])
+	assert.NoError(t, err)
+	assert.Equal(t, 2, logins)
+	assert.Equal(t, 2, tokenRenewals)
+}
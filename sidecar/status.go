@@ -0,0 +1,69 @@
+package sidecar
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/utilitywarehouse/go-operational/op"
+)
+
+// renewalStatus records the outcome of the renewal loop, so that it can be
+// reported by the health and readiness checks
+type renewalStatus struct {
+	mu          sync.Mutex
+	margin      time.Duration
+	expiry      time.Time
+	lastErr     error
+	nextAttempt time.Time
+}
+
+// succeeded records a successful renewal of credentials that expire at
+// expiry, and the time of the next renewal
+func (rs *renewalStatus) succeeded(expiry, next time.Time) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rs.expiry = expiry
+	rs.lastErr = nil
+	rs.nextAttempt = next
+}
+
+// failed records a failed renewal and the time of the next attempt
+func (rs *renewalStatus) failed(err error, next time.Time) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rs.lastErr = err
+	rs.nextAttempt = next
+}
+
+// ready returns true when there are credentials that can be served
+func (rs *renewalStatus) ready() bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	return !rs.expiry.IsZero() && !expiresWithin(rs.expiry, rs.margin)
+}
+
+// check reports the health of the credentials. They are unhealthy when there
+// aren't any that can be served and degraded while renewals are failing.
+func (rs *renewalStatus) check(cr *op.CheckResponse) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	next := rs.nextAttempt.Format(time.RFC3339)
+
+	switch {
+	case rs.expiry.IsZero() && rs.lastErr == nil:
+		cr.Unhealthy("waiting for the first credentials", "wait for the first renewal to complete", "credentials are not being served")
+	case rs.expiry.IsZero():
+		cr.Unhealthy(fmt.Sprintf("error retrieving credentials: %v, next attempt at %s", rs.lastErr, next), "check the sidecar logs and the vault configuration", "credentials are not being served")
+	case expiresWithin(rs.expiry, rs.margin):
+		cr.Unhealthy(fmt.Sprintf("credentials expired at %s, last error: %v, next attempt at %s", rs.expiry.Format(time.RFC3339), rs.lastErr, next), "check the sidecar logs and the vault configuration", "credentials are not being served")
+	case rs.lastErr != nil:
+		cr.Degraded(fmt.Sprintf("error renewing credentials: %v, next attempt at %s, current credentials expire at %s", rs.lastErr, next, rs.expiry.Format(time.RFC3339)), "check the sidecar logs and the vault configuration")
+	default:
+		cr.Healthy(fmt.Sprintf("credentials expire at %s, next renewal at %s", rs.expiry.Format(time.RFC3339), next))
+	}
+}
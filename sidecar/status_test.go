@@ -0,0 +1,31 @@
+package sidecar
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRenewalStatusReady tests that the sidecar is only ready while it has
+// credentials that can be served
+func TestRenewalStatusReady(t *testing.T) {
+	rs := &renewalStatus{margin: time.Minute}
+
+	// Test that it isn't ready before the first renewal
+	assert.False(t, rs.ready())
+	rs.failed(errors.New("foobar"), time.Now().Add(time.Second))
+	assert.False(t, rs.ready())
+
+	// Test that it's ready after a successful renewal and remains ready
+	// while renewals fail
+	rs.succeeded(time.Now().Add(time.Hour), time.Now().Add(20*time.Minute))
+	assert.True(t, rs.ready())
+	rs.failed(errors.New("foobar"), time.Now().Add(time.Second))
+	assert.True(t, rs.ready())
+
+	// Test that it isn't ready once the credentials are within the margin
+	rs.succeeded(time.Now().Add(30*time.Second), time.Now())
+	assert.False(t, rs.ready())
+}
@@ -7,17 +7,67 @@ import (
 	"github.com/dgrijalva/jwt-go"
 )
 
+// kubeTokenClaims are the details of the service account (and pod, for bound
+// tokens) extracted from a Kubernetes service account token
 type kubeTokenClaims struct {
+	Namespace          string
+	ServiceAccountName string
+	ServiceAccountUID  string
+	PodName            string
+	PodUID             string
+}
+
+// rawKubeTokenClaims understands both the flat claims in legacy service
+// account tokens and the nested claims in projected, audience-bound tokens
+type rawKubeTokenClaims struct {
+	// Legacy tokens
 	Namespace          string `json:"kubernetes.io/serviceaccount/namespace"`
 	ServiceAccountName string `json:"kubernetes.io/serviceaccount/service-account.name"`
+	ServiceAccountUID  string `json:"kubernetes.io/serviceaccount/service-account.uid"`
+
+	// Projected tokens
+	Kubernetes *struct {
+		Namespace      string `json:"namespace"`
+		ServiceAccount struct {
+			Name string `json:"name"`
+			UID  string `json:"uid"`
+		} `json:"serviceaccount"`
+		Pod *struct {
+			Name string `json:"name"`
+			UID  string `json:"uid"`
+		} `json:"pod"`
+	} `json:"kubernetes.io"`
 }
 
 // Valid implements jwt.Claims. It's never called because we're only running
 // ParseUnverified.
-func (c *kubeTokenClaims) Valid() error {
+func (c *rawKubeTokenClaims) Valid() error {
 	return nil
 }
 
+// claims returns the claims from the projected format if they are present,
+// otherwise from the legacy format
+func (c *rawKubeTokenClaims) claims() *kubeTokenClaims {
+	if c.Kubernetes != nil {
+		claims := &kubeTokenClaims{
+			Namespace:          c.Kubernetes.Namespace,
+			ServiceAccountName: c.Kubernetes.ServiceAccount.Name,
+			ServiceAccountUID:  c.Kubernetes.ServiceAccount.UID,
+		}
+		if c.Kubernetes.Pod != nil {
+			claims.PodName = c.Kubernetes.Pod.Name
+			claims.PodUID = c.Kubernetes.Pod.UID
+		}
+		return claims
+	}
+
+	return &kubeTokenClaims{
+		Namespace:          c.Namespace,
+		ServiceAccountName: c.ServiceAccountName,
+		ServiceAccountUID:  c.ServiceAccountUID,
+	}
+}
+
 func newKubeTokenClaimsFromFile(tokenFile string) (*kubeTokenClaims, error) {
 	token, err := ioutil.ReadFile(tokenFile)
 	if err != nil {
@@ -26,17 +76,19 @@ func newKubeTokenClaimsFromFile(tokenFile string) (*kubeTokenClaims, error) {
 
 	jwtParser := &jwt.Parser{}
 
-	claims := &kubeTokenClaims{}
-	if _, _, err := jwtParser.ParseUnverified(string(token), claims); err != nil {
+	raw := &rawKubeTokenClaims{}
+	if _, _, err := jwtParser.ParseUnverified(string(token), raw); err != nil {
 		return nil, err
 	}
 
+	claims := raw.claims()
+
 	if claims.Namespace == "" {
-		return claims, fmt.Errorf("missing claim for kubernetes.io/serviceaccount/namespace")
+		return claims, fmt.Errorf("missing claim for kubernetes.io/serviceaccount/namespace or kubernetes.io.namespace")
 	}
 
 	if claims.ServiceAccountName == "" {
-		return claims, fmt.Errorf("missing claim for kubernetes.io/serviceaccount/service-account.name")
+		return claims, fmt.Errorf("missing claim for kubernetes.io/serviceaccount/service-account.name or kubernetes.io.serviceaccount.name")
 	}
 
 	return claims, nil
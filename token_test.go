@@ -70,3 +70,78 @@ func TestNewKubeTokenClaimsFromFileInvalidClaims(t *testing.T) {
 	_, err = newKubeTokenClaimsFromFile(tmpFile.Name())
 	assert.Error(t, err)
 }
+
+func TestNewKubeTokenClaimsFromFileProjected(t *testing.T) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"aud": []string{"vault"},
+		"iss": "https://kubernetes.default.svc.cluster.local",
+		"kubernetes.io": map[string]interface{}{
+			"namespace": "foo",
+			"pod": map[string]interface{}{
+				"name": "bar-5d8f9c7b6-xk2lp",
+				"uid":  "0a3bc0d4-6f6e-4c2b-9a3e-5d7d5b0c2f11",
+			},
+			"serviceaccount": map[string]interface{}{
+				"name": "bar",
+				"uid":  "d8f5785e-1477-11eb-adc1-0242ac120002",
+			},
+		},
+		"sub": "system:serviceaccount:foo:bar",
+	})
+
+	ss, err := token.SignedString([]byte("SuperDuperSecure"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpFile, err := ioutil.TempFile("", "jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write([]byte(ss)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := newKubeTokenClaimsFromFile(tmpFile.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", claims.Namespace)
+	assert.Equal(t, "bar", claims.ServiceAccountName)
+	assert.Equal(t, "d8f5785e-1477-11eb-adc1-0242ac120002", claims.ServiceAccountUID)
+	assert.Equal(t, "bar-5d8f9c7b6-xk2lp", claims.PodName)
+	assert.Equal(t, "0a3bc0d4-6f6e-4c2b-9a3e-5d7d5b0c2f11", claims.PodUID)
+}
+
+func TestNewKubeTokenClaimsFromFileProjectedInvalidClaims(t *testing.T) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"aud": []string{"vault"},
+		"iss": "https://kubernetes.default.svc.cluster.local",
+		"kubernetes.io": map[string]interface{}{
+			"namespace": "foo",
+		},
+		"sub": "system:serviceaccount:foo:bar",
+	})
+
+	ss, err := token.SignedString([]byte("SuperDuperSecure"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpFile, err := ioutil.TempFile("", "jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write([]byte(ss)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = newKubeTokenClaimsFromFile(tmpFile.Name())
+	assert.Error(t, err)
+}